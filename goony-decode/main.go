@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/peryaudo/goony/winny/proto"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// goony-decode prints the Winny commands in a pcap file.
+//
+//	goony-decode [-port 4504] capture.pcap
+
+type decodedLine struct {
+	Time time.Time
+	Flow flowKey
+	Cmd  *proto.DecodedCmd
+}
+
+func main() {
+	port := flag.Int("port", 0, "decode only the connections with the port (0 for all)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [-port port] capture.pcap\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer f.Close()
+
+	flows, err := readFlows(f)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var lines []*decodedLine
+	for _, fl := range flows {
+		if *port != 0 && int(fl.Key.SrcPort) != *port && int(fl.Key.DstPort) != *port {
+			continue
+		}
+		lines = append(lines, decodeFlow(fl)...)
+	}
+
+	// Interleave both directions of the connections by the capture time.
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Time.Before(lines[j].Time) })
+	for _, l := range lines {
+		fmt.Printf("%s %s %s %+v\n", l.Time.Format("15:04:05.000000"), l.Flow, l.Cmd.Name, l.Cmd.Cmd)
+	}
+}
+
+func decodeFlow(fl *flow) (lines []*decodedLine) {
+	s := fl.reassemble()
+	if len(s.Data) == 0 {
+		return
+	}
+
+	d := proto.NewStreamDecoder(bytes.NewReader(s.Data))
+	for {
+		c, err := d.Next()
+		if c != nil {
+			lines = append(lines, &decodedLine{Time: s.timeAt(c.Offset), Flow: fl.Key, Cmd: c})
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("%s: %v\n", fl.Key, err)
+			if c == nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+)
+
+// This file implements a minimal reader of pcap files and TCP stream reassembly.
+// Only IPv4 over Ethernet, Linux cooked capture, loopback and raw IP links are supported.
+
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSll = 113
+)
+
+type packet struct {
+	Time time.Time
+	Data []byte
+}
+
+type pcapReader struct {
+	r         io.Reader
+	order     binary.ByteOrder
+	nanosec   bool
+	linkType  uint32
+	headerBuf [16]byte
+}
+
+func newPcapReader(r io.Reader) (p *pcapReader, err error) {
+	var hdr [24]byte
+	_, err = io.ReadFull(r, hdr[:])
+	if err != nil {
+		return
+	}
+
+	p = &pcapReader{r: r}
+	switch {
+	case binary.LittleEndian.Uint32(hdr[0:4]) == 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[0:4]) == 0xa1b2c3d4:
+		p.order = binary.BigEndian
+	case binary.LittleEndian.Uint32(hdr[0:4]) == 0xa1b23c4d:
+		p.order, p.nanosec = binary.LittleEndian, true
+	case binary.BigEndian.Uint32(hdr[0:4]) == 0xa1b23c4d:
+		p.order, p.nanosec = binary.BigEndian, true
+	default:
+		return nil, errors.New("not a pcap file (pcapng is not supported)")
+	}
+	p.linkType = p.order.Uint32(hdr[20:24])
+	return
+}
+
+func (p *pcapReader) Next() (pkt *packet, err error) {
+	_, err = io.ReadFull(p.r, p.headerBuf[:])
+	if err != nil {
+		return
+	}
+
+	sec := int64(p.order.Uint32(p.headerBuf[0:4]))
+	frac := int64(p.order.Uint32(p.headerBuf[4:8]))
+	if !p.nanosec {
+		frac *= 1000
+	}
+	capLen := p.order.Uint32(p.headerBuf[8:12])
+	if capLen > 256*1024 {
+		return nil, errors.New(fmt.Sprintf("packet too large: %d", capLen))
+	}
+
+	pkt = &packet{Time: time.Unix(sec, frac), Data: make([]byte, capLen)}
+	_, err = io.ReadFull(p.r, pkt.Data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// ipPayload strips the link layer header and returns the IPv4 packet.
+func (p *pcapReader) ipPayload(data []byte) []byte {
+	switch p.linkType {
+	case linkTypeNull:
+		if len(data) < 4 {
+			return nil
+		}
+		return data[4:]
+	case linkTypeEthernet:
+		if len(data) < 14 || binary.BigEndian.Uint16(data[12:14]) != 0x0800 {
+			return nil
+		}
+		return data[14:]
+	case linkTypeRaw:
+		return data
+	case linkTypeLinuxSll:
+		if len(data) < 16 || binary.BigEndian.Uint16(data[14:16]) != 0x0800 {
+			return nil
+		}
+		return data[16:]
+	}
+	return nil
+}
+
+// flowKey identifies one direction of a TCP connection.
+type flowKey struct {
+	SrcIP, DstIP     [4]byte
+	SrcPort, DstPort uint16
+}
+
+func (k flowKey) String() string {
+	return fmt.Sprintf("%s:%d->%s:%d", net.IP(k.SrcIP[:]), k.SrcPort, net.IP(k.DstIP[:]), k.DstPort)
+}
+
+type segment struct {
+	Seq  uint32 // relative to the initial sequence number
+	Time time.Time
+	Data []byte
+}
+
+// flow is one direction of a TCP connection.
+type flow struct {
+	Key      flowKey
+	isn      uint32
+	segments []*segment
+}
+
+// parseTCP parses the IPv4 packet and returns the TCP segment in it.
+func parseTCP(ip []byte) (key flowKey, seq uint32, syn bool, payload []byte, ok bool) {
+	if len(ip) < 20 || ip[0]>>4 != 4 || ip[9] != 6 {
+		return
+	}
+	ihl := int(ip[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(ip[2:4]))
+	if total > len(ip) || total < ihl+20 {
+		return
+	}
+	// Fragments are not supported.
+	if binary.BigEndian.Uint16(ip[6:8])&0x3fff != 0 {
+		return
+	}
+	copy(key.SrcIP[:], ip[12:16])
+	copy(key.DstIP[:], ip[16:20])
+
+	tcp := ip[ihl:total]
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(tcp) {
+		return
+	}
+	key.SrcPort = binary.BigEndian.Uint16(tcp[0:2])
+	key.DstPort = binary.BigEndian.Uint16(tcp[2:4])
+	seq = binary.BigEndian.Uint32(tcp[4:8])
+	syn = tcp[13]&0x02 != 0
+	payload = tcp[dataOffset:]
+	ok = true
+	return
+}
+
+// readFlows reads all the TCP flows in the pcap file.
+func readFlows(r io.Reader) (flows []*flow, err error) {
+	p, err := newPcapReader(r)
+	if err != nil {
+		return
+	}
+
+	byKey := make(map[flowKey]*flow)
+	for {
+		var pkt *packet
+		pkt, err = p.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+
+		key, seq, syn, payload, ok := parseTCP(p.ipPayload(pkt.Data))
+		if !ok {
+			continue
+		}
+
+		f := byKey[key]
+		if f == nil || (syn && seq+1 != f.isn) {
+			// A SYN starts a new connection on the same addresses unless it is retransmitted.
+			f = &flow{Key: key, isn: seq}
+			if syn {
+				f.isn++
+			}
+			byKey[key] = f
+			flows = append(flows, f)
+		}
+		if len(payload) > 0 {
+			data := append([]byte{}, payload...)
+			f.segments = append(f.segments, &segment{Seq: seq - f.isn, Time: pkt.Time, Data: data})
+		}
+	}
+	return
+}
+
+// stream is the reassembled bytes of a flow.
+type stream struct {
+	Data     []byte
+	segments []*segment // the segments starting at each new offset, in the order of the offsets
+}
+
+// reassemble concatenates the segments in the order of the sequence numbers.
+// Retransmitted data is ignored and the reassembly stops at the first gap.
+func (f *flow) reassemble() *stream {
+	segs := append([]*segment{}, f.segments...)
+	sort.SliceStable(segs, func(i, j int) bool { return int32(segs[i].Seq-segs[j].Seq) < 0 })
+
+	s := &stream{}
+	for _, seg := range segs {
+		end := uint32(len(s.Data))
+		if int32(seg.Seq-end) > 0 {
+			break
+		}
+		skip := end - seg.Seq
+		if int(skip) >= len(seg.Data) {
+			continue
+		}
+		s.segments = append(s.segments, &segment{Seq: end, Time: seg.Time, Data: seg.Data[skip:]})
+		s.Data = append(s.Data, seg.Data[skip:]...)
+	}
+	return s
+}
+
+// timeAt returns the capture time of the byte at the offset.
+func (s *stream) timeAt(offset int64) time.Time {
+	i := sort.Search(len(s.segments), func(i int) bool { return int64(s.segments[i].Seq) > offset })
+	if i == 0 {
+		return time.Time{}
+	}
+	return s.segments[i-1].Time
+}
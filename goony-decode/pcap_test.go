@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+var testKey = flowKey{
+	SrcIP:   [4]byte{10, 0, 0, 1},
+	DstIP:   [4]byte{10, 0, 0, 2},
+	SrcPort: 1234,
+	DstPort: 4504}
+
+// ipv4TCP builds an IPv4 packet of the TCP segment. Checksums are not filled.
+func ipv4TCP(key flowKey, seq uint32, syn bool, payload []byte) []byte {
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:2], key.SrcPort)
+	binary.BigEndian.PutUint16(tcp[2:4], key.DstPort)
+	binary.BigEndian.PutUint32(tcp[4:8], seq)
+	tcp[12] = 5 << 4
+	if syn {
+		tcp[13] = 0x02
+	}
+	copy(tcp[20:], payload)
+
+	ip := make([]byte, 20, 20+len(tcp))
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(tcp)))
+	ip[9] = 6
+	copy(ip[12:16], key.SrcIP[:])
+	copy(ip[16:20], key.DstIP[:])
+	return append(ip, tcp...)
+}
+
+func TestParseTCP(t *testing.T) {
+	ip := ipv4TCP(testKey, 100, true, []byte("abc"))
+	key, seq, syn, payload, ok := parseTCP(ip)
+	if !ok || key != testKey || seq != 100 || !syn || string(payload) != "abc" {
+		t.Errorf("unexpected result: %v %d %v %q %v", key, seq, syn, payload, ok)
+	}
+
+	// Trailing bytes beyond the total length, such as Ethernet padding, are ignored.
+	if _, _, _, payload, ok := parseTCP(append(ip, 0, 0)); !ok || string(payload) != "abc" {
+		t.Errorf("padding not stripped: %q %v", payload, ok)
+	}
+
+	fragment := append([]byte{}, ip...)
+	fragment[6] = 0x20 // more fragments
+	udp := append([]byte{}, ip...)
+	udp[9] = 17
+	badOffset := append([]byte{}, ip...)
+	badOffset[20+12] = 15 << 4
+
+	for i, b := range [][]byte{nil, ip[:19], ip[:30], fragment, udp, badOffset} {
+		if _, _, _, _, ok := parseTCP(b); ok {
+			t.Errorf("case %d: invalid packet accepted", i)
+		}
+	}
+}
+
+func TestReassemble(t *testing.T) {
+	base := time.Unix(1000, 0)
+	f := &flow{Key: testKey, segments: []*segment{
+		{Seq: 3, Time: base.Add(2 * time.Second), Data: []byte("def")},
+		{Seq: 0, Time: base, Data: []byte("abc")},
+		// Retransmission overlapping the received data, which provides the bytes after "abc"
+		// because it starts earlier than "def"
+		{Seq: 2, Time: base.Add(3 * time.Second), Data: []byte("cdefg")},
+		{Seq: 0, Time: base.Add(4 * time.Second), Data: []byte("ab")},
+		// After a gap
+		{Seq: 10, Time: base.Add(5 * time.Second), Data: []byte("xyz")}}}
+
+	s := f.reassemble()
+	if string(s.Data) != "abcdefg" {
+		t.Errorf("unexpected data: %q", s.Data)
+	}
+
+	cases := []struct {
+		offset int64
+		time   time.Time
+	}{{0, base}, {2, base}, {3, base.Add(3 * time.Second)}, {6, base.Add(3 * time.Second)}}
+	for _, c := range cases {
+		if at := s.timeAt(c.offset); !at.Equal(c.time) {
+			t.Errorf("offset %d: expected %v, actual %v", c.offset, c.time, at)
+		}
+	}
+}
+
+func TestReadFlows(t *testing.T) {
+	var b bytes.Buffer
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint32(hdr[20:24], linkTypeRaw)
+	b.Write(hdr)
+
+	writePacket := func(sec uint32, data []byte) {
+		rec := make([]byte, 16)
+		binary.LittleEndian.PutUint32(rec[0:4], sec)
+		binary.LittleEndian.PutUint32(rec[8:12], uint32(len(data)))
+		binary.LittleEndian.PutUint32(rec[12:16], uint32(len(data)))
+		b.Write(rec)
+		b.Write(data)
+	}
+
+	// The sequence numbers wrap around in the middle of the flow.
+	isn := uint32(0xfffffffe)
+	writePacket(1, ipv4TCP(testKey, isn, true, nil))
+	writePacket(2, ipv4TCP(testKey, isn+4, false, []byte("def")))
+	writePacket(3, ipv4TCP(testKey, isn+1, false, []byte("abc")))
+	// A new connection on the same addresses
+	writePacket(4, ipv4TCP(testKey, 500, true, nil))
+	writePacket(5, ipv4TCP(testKey, 501, false, []byte("new")))
+
+	flows, err := readFlows(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flows) != 2 {
+		t.Fatalf("expected 2 flows, actual %d", len(flows))
+	}
+	if s := flows[0].reassemble(); string(s.Data) != "abcdef" || s.timeAt(3).Unix() != 2 {
+		t.Errorf("unexpected first flow: %q", s.Data)
+	}
+	if s := flows[1].reassemble(); string(s.Data) != "new" {
+		t.Errorf("unexpected second flow: %q", s.Data)
+	}
+}
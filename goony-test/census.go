@@ -0,0 +1,60 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/peryaudo/goony/winny"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// goony-test census runs the servent without searching and prints the census of the known nodes periodically.
+//
+//	goony-test census [-interval 10m]
+func runCensus(args []string) {
+	flags := flag.NewFlagSet("census", flag.ExitOnError)
+	interval := flags.Duration("interval", 10*time.Minute, "interval between the reports")
+	flags.Parse(args)
+
+	servent := winny.Servent{
+		Speed: 10000,
+		Port:  4504}
+
+	go func() {
+		err := readNoderef(&servent)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		for {
+			time.Sleep(*interval)
+			writeNoderef(&servent)
+			printCensus(os.Stdout, servent.Census())
+		}
+	}()
+
+	log.Fatalln(servent.ListenAndServe())
+}
+
+func printCensus(w io.Writer, c *winny.Census) {
+	fmt.Fprintf(w, "census at %s: known %d, identified %d, connected %d\n",
+		c.Time.Format(time.RFC3339), c.Known, c.Identified, c.Connected)
+
+	sections := []struct {
+		name   string
+		groups []winny.CensusGroup
+	}{
+		{"type", c.Types},
+		{"software", c.Software},
+		{"version", c.Versions},
+		{"speed", c.SpeedBands},
+		{"cluster", c.Clusters},
+		{"nat", c.Nat}}
+	for _, s := range sections {
+		for _, g := range s.groups {
+			fmt.Fprintf(w, "%s\t%d\t%q\n", s.name, g.Count, g.Key)
+		}
+	}
+}
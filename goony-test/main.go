@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/peryaudo/goony/winny"
 	"io"
@@ -14,6 +15,11 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "census" {
+		runCensus(os.Args[2:])
+		return
+	}
+
 	go func() {
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "goony connectability test")
@@ -38,10 +44,13 @@ func main() {
 	}()
 
 	go func() {
-		// ch, _ := servent.Search(".jpg")
-		ch, _ := servent.Search("")
+		// sub, err := servent.Search(context.Background(), "ext:jpg", winny.SubscriptionOptions{})
+		sub, err := servent.Search(context.Background(), "", winny.SubscriptionOptions{})
+		if err != nil {
+			log.Fatalln(err)
+		}
 		cnt := 0
-		for key := range ch {
+		for key := range sub.Results {
 			// log.Printf("File: %s\n", maskKeyword(key.FileName))
 			// log.Printf("%d File: %s\n", cnt, key.FileName)
 			log.Printf("File: %s\n", key.FileName)
@@ -50,10 +59,10 @@ func main() {
 	}()
 
 	go func() {
-		ch, _ := servent.KeywordStream()
-		for kw := range ch {
-			// log.Printf("Search: %s\n", maskKeyword(kw))
-			log.Printf("Search: %s\n", kw)
+		sub := servent.KeywordStream(context.Background(), winny.SubscriptionOptions{})
+		for ev := range sub.Events {
+			// log.Printf("Search: %s\n", maskKeyword(ev.Keyword))
+			log.Printf("Search: %s (id: %d path: %d hops from: %s)\n", ev.Keyword, ev.Id, len(ev.Path), ev.Peer)
 		}
 	}()
 
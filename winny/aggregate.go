@@ -0,0 +1,107 @@
+package winny
+
+import (
+	"time"
+)
+
+// Maximum number of sources remembered for each file.
+// The least recently seen source is forgotten first.
+const maxKeySources = 64
+
+// Maximum number of file names remembered for each file.
+// Names announced after the limit are ignored.
+const maxKeyFileNames = 16
+
+// AggregatedKey aggregates all the announcements of the file with the same hash.
+type AggregatedKey struct {
+	// The first announced key.
+	FileKey
+
+	// Nodes announcing the file, most recently seen first.
+	Sources []KeySource
+
+	FirstSeen time.Time
+	LastSeen  time.Time
+	MaxRefCnt uint32
+
+	// Distinct file names announced for the hash, in the order of appearance.
+	// Up to maxKeyFileNames names are kept.
+	FileNames []string
+}
+
+// KeySource is a node announcing the file.
+type KeySource struct {
+	Addr     string // host:port
+	LastSeen time.Time
+}
+
+type keySource struct {
+	Addr     nodeAddr
+	LastSeen time.Time
+}
+
+type keyAggregate struct {
+	Sources   []keySource // sorted by LastSeen in the ascending order
+	FirstSeen time.Time
+	LastSeen  time.Time
+	MaxRefCnt uint32
+	FileNames []string
+}
+
+func newKeyAggregate(k *FileKey, now time.Time) *keyAggregate {
+	return &keyAggregate{
+		Sources:   []keySource{{Addr: k.Node, LastSeen: now}},
+		FirstSeen: now,
+		LastSeen:  now,
+		MaxRefCnt: k.RefCnt,
+		FileNames: []string{k.FileName}}
+}
+
+// update merges the announcement of the key.
+func (a *keyAggregate) update(k *FileKey, now time.Time) {
+	a.LastSeen = now
+	if k.RefCnt > a.MaxRefCnt {
+		a.MaxRefCnt = k.RefCnt
+	}
+
+	found := false
+	for _, name := range a.FileNames {
+		if name == k.FileName {
+			found = true
+			break
+		}
+	}
+	if !found && len(a.FileNames) < maxKeyFileNames {
+		a.FileNames = append(a.FileNames, k.FileName)
+	}
+
+	// Move the source to the end as the most recently seen one.
+	for i, src := range a.Sources {
+		if src.Addr == k.Node {
+			a.Sources = append(a.Sources[:i], a.Sources[i+1:]...)
+			break
+		}
+	}
+	if len(a.Sources) >= maxKeySources {
+		a.Sources = a.Sources[1:]
+	}
+	a.Sources = append(a.Sources, keySource{Addr: k.Node, LastSeen: now})
+}
+
+// snapshot returns a copy of the aggregate that is safe to pass to other goroutines.
+func (a *keyAggregate) snapshot(k *FileKey) *AggregatedKey {
+	agg := &AggregatedKey{
+		FileKey:   *k,
+		Sources:   make([]KeySource, len(a.Sources)),
+		FirstSeen: a.FirstSeen,
+		LastSeen:  a.LastSeen,
+		MaxRefCnt: a.MaxRefCnt,
+		FileNames: append([]string{}, a.FileNames...)}
+
+	for i, src := range a.Sources {
+		agg.Sources[len(a.Sources)-1-i] = KeySource{
+			Addr:     src.Addr.String(),
+			LastSeen: src.LastSeen}
+	}
+	return agg
+}
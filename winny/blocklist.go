@@ -0,0 +1,178 @@
+package winny
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blocklist is a list of IP address ranges the servent refuses to communicate with.
+// It is safe for concurrent use.
+type Blocklist struct {
+	mu     sync.RWMutex
+	ranges []ipRange // sorted by First
+}
+
+type ipRange struct {
+	First uint32
+	Last  uint32
+}
+
+// Loads a blocklist in the PeerGuardian text (P2P) format.
+// Each line is either "description:first-last", "first-last" or a single IP address.
+// Empty lines and lines beginning with # are ignored.
+func LoadBlocklist(r io.Reader) (b *Blocklist, err error) {
+	b = &Blocklist{}
+
+	sc := bufio.NewScanner(r)
+	lineNum := 0
+	for sc.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		// The description may contain colons, so the range begins after the last one.
+		if i := strings.LastIndex(line, ":"); i >= 0 {
+			line = line[i+1:]
+		}
+
+		first, last := line, line
+		if i := strings.Index(line, "-"); i >= 0 {
+			first, last = line[:i], line[i+1:]
+		}
+
+		firstIP := net.ParseIP(strings.TrimSpace(first)).To4()
+		lastIP := net.ParseIP(strings.TrimSpace(last)).To4()
+		if firstIP == nil || lastIP == nil {
+			err = errors.New(fmt.Sprintf("invalid blocklist range at line %d: %s", lineNum, sc.Text()))
+			return
+		}
+
+		b.ranges = append(b.ranges, ipRange{First: ipToUint32(firstIP), Last: ipToUint32(lastIP)})
+	}
+	err = sc.Err()
+	if err != nil {
+		return
+	}
+
+	b.normalize()
+	return
+}
+
+// Loads a blocklist file in the PeerGuardian text (P2P) format.
+func LoadBlocklistFile(name string) (b *Blocklist, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	return LoadBlocklist(f)
+}
+
+// Adds the IP address range from first to last inclusive.
+func (b *Blocklist) Add(first, last net.IP) {
+	first, last = first.To4(), last.To4()
+	if first == nil || last == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.ranges = append(b.ranges, ipRange{First: ipToUint32(first), Last: ipToUint32(last)})
+	b.normalize()
+}
+
+// Returns true if the IP address is in the blocklist.
+// A nil Blocklist contains nothing.
+func (b *Blocklist) Contains(ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	ip = ip.To4()
+	if ip == nil {
+		return false
+	}
+	n := ipToUint32(ip)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	// Find the first range beginning after the IP; the one just before it is the only candidate.
+	i := sort.Search(len(b.ranges), func(i int) bool { return b.ranges[i].First > n })
+	return i > 0 && n <= b.ranges[i-1].Last
+}
+
+// normalize sorts the ranges and merges the overlapping ones.
+func (b *Blocklist) normalize() {
+	for i, r := range b.ranges {
+		if r.First > r.Last {
+			b.ranges[i].First, b.ranges[i].Last = r.Last, r.First
+		}
+	}
+	sort.Slice(b.ranges, func(i, j int) bool { return b.ranges[i].First < b.ranges[j].First })
+
+	merged := b.ranges[:0]
+	for _, r := range b.ranges {
+		last := len(merged) - 1
+		if last >= 0 && (merged[last].Last == ^uint32(0) || r.First <= merged[last].Last+1) {
+			if r.Last > merged[last].Last {
+				merged[last].Last = r.Last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	b.ranges = merged
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+// Duration of the temporary ban for misbehaving peers.
+const peerBanDuration = 30 * time.Minute
+
+// banList holds temporarily banned peers.
+// It is safe for concurrent use because the listener goroutine checks it on accept.
+type banList struct {
+	mu    sync.Mutex
+	until map[[4]byte]time.Time
+}
+
+func newBanList() *banList {
+	return &banList{until: make(map[[4]byte]time.Time)}
+}
+
+func (b *banList) Ban(ip [4]byte, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.until[ip] = time.Now().Add(d)
+}
+
+func (b *banList) IsBanned(ip [4]byte) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.until[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(b.until, ip)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package winny
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLoadBlocklist(t *testing.T) {
+	src := `# comment
+Some Organization:49.253.0.0-49.253.255.255
+Name: with colons:111.249.228.0-111.249.228.127
+111.249.228.100-111.249.228.200
+
+10.0.0.1
+`
+	b, err := LoadBlocklist(strings.NewReader(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contained := []string{"49.253.181.126", "111.249.228.0", "111.249.228.150", "111.249.228.200", "10.0.0.1"}
+	notContained := []string{"49.252.255.255", "49.254.0.0", "111.249.228.201", "10.0.0.2", "0.0.0.0"}
+
+	for _, ip := range contained {
+		if !b.Contains(net.ParseIP(ip)) {
+			t.Errorf("%s should be contained", ip)
+		}
+	}
+	for _, ip := range notContained {
+		if b.Contains(net.ParseIP(ip)) {
+			t.Errorf("%s should not be contained", ip)
+		}
+	}
+
+	// Overlapping ranges are merged.
+	if len(b.ranges) != 3 {
+		t.Errorf("ranges not merged: %#v", b.ranges)
+	}
+
+	_, err = LoadBlocklist(strings.NewReader("invalid:1.2.3-1.2.3.4\n"))
+	if err == nil {
+		t.Error("invalid range accepted")
+	}
+}
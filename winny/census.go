@@ -0,0 +1,106 @@
+package winny
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Census summarizes the client software and the conditions of the known nodes.
+// Only the nodes whose handshakes have been observed are grouped,
+// because the other nodes are known only by their addresses.
+type Census struct {
+	Time time.Time
+
+	Known      int // all the known nodes
+	Identified int // the nodes whose handshakes have been observed
+	Connected  int
+
+	// Groups sorted in the descending order of the counts.
+	Types      []CensusGroup // by PeerType
+	Software   []CensusGroup // by cert string
+	Versions   []CensusGroup
+	SpeedBands []CensusGroup // in kbps
+	Clusters   []CensusGroup // by cluster word; a node is counted once for each of its words
+	Nat        []CensusGroup // "nat" or "direct"
+}
+
+// CensusGroup is the number of the nodes sharing the key.
+type CensusGroup struct {
+	Key   string
+	Count int
+}
+
+// Upper bounds of the speed bands in kbps.
+var censusSpeedBands = []int{100, 1000, 10000, 100000}
+
+func speedBand(speed int) string {
+	lower := 0
+	for _, upper := range censusSpeedBands {
+		if speed < upper {
+			return fmt.Sprintf("%d-%d", lower, upper-1)
+		}
+		lower = upper
+	}
+	return fmt.Sprintf("%d-", lower)
+}
+
+// census builds the census of the known nodes.
+func (m *nodeMgr) census() *Census {
+	c := &Census{
+		Time:      time.Now(),
+		Known:     len(m.nodes),
+		Connected: len(m.connNodes)}
+
+	types := make(map[string]int)
+	software := make(map[string]int)
+	versions := make(map[string]int)
+	speeds := make(map[string]int)
+	clusters := make(map[string]int)
+	nat := make(map[string]int)
+
+	for _, info := range m.nodes {
+		if info == nil || info.Ver == 0 {
+			continue
+		}
+		c.Identified++
+
+		types[ClassifyPeer(info.CertStr).String()]++
+		software[info.CertStr]++
+		versions[strconv.Itoa(info.Ver)]++
+		speeds[speedBand(info.Speed)]++
+		for _, word := range info.Clusters {
+			if len(word) > 0 {
+				clusters[word]++
+			}
+		}
+		if info.IsNat {
+			nat["nat"]++
+		} else {
+			nat["direct"]++
+		}
+	}
+
+	c.Types = censusGroups(types)
+	c.Software = censusGroups(software)
+	c.Versions = censusGroups(versions)
+	c.SpeedBands = censusGroups(speeds)
+	c.Clusters = censusGroups(clusters)
+	c.Nat = censusGroups(nat)
+	return c
+}
+
+func censusGroups(counts map[string]int) []CensusGroup {
+	groups := make([]CensusGroup, 0, len(counts))
+	for key, count := range counts {
+		groups = append(groups, CensusGroup{Key: key, Count: count})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Count != groups[j].Count {
+			return groups[i].Count > groups[j].Count
+		}
+		return groups[i].Key < groups[j].Key
+	})
+	return groups
+}
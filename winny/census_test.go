@@ -0,0 +1,40 @@
+package winny
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCensus(t *testing.T) {
+	m := newNodeMgr(&Servent{})
+
+	m.nodes[nodeAddr{IP: [4]byte{1, 1, 1, 1}, Port: 1}] = &nodeInfo{
+		Ver: 12710, CertStr: "Winny Ver2.0b1", Speed: 120, Clusters: [3]string{"a", "b", ""}}
+	m.nodes[nodeAddr{IP: [4]byte{2, 2, 2, 2}, Port: 2}] = &nodeInfo{
+		Ver: 12710, CertStr: "Winny Ver2.0b1", Speed: 500, Clusters: [3]string{"a", "", ""}, IsNat: true}
+	m.nodes[nodeAddr{IP: [4]byte{3, 3, 3, 3}, Port: 3}] = &nodeInfo{
+		Ver: 12710, CertStr: "Winny Ver2.0b1 (goony)", Speed: 100000}
+	m.nodes[nodeAddr{IP: [4]byte{4, 4, 4, 4}, Port: 4}] = &nodeInfo{}
+	m.connNodes[nodeAddr{IP: [4]byte{1, 1, 1, 1}, Port: 1}] = &nodeConn{}
+
+	c := m.census()
+	if c.Known != 4 || c.Identified != 3 || c.Connected != 1 {
+		t.Errorf("unexpected counts: %d %d %d", c.Known, c.Identified, c.Connected)
+	}
+
+	cases := []struct {
+		actual   []CensusGroup
+		expected []CensusGroup
+	}{
+		{c.Types, []CensusGroup{{"Winny", 2}, {"clone", 1}}},
+		{c.Software, []CensusGroup{{"Winny Ver2.0b1", 2}, {"Winny Ver2.0b1 (goony)", 1}}},
+		{c.Versions, []CensusGroup{{"12710", 3}}},
+		{c.SpeedBands, []CensusGroup{{"100-999", 2}, {"100000-", 1}}},
+		{c.Clusters, []CensusGroup{{"a", 2}, {"b", 1}}},
+		{c.Nat, []CensusGroup{{"direct", 2}, {"nat", 1}}}}
+	for i, cs := range cases {
+		if !reflect.DeepEqual(cs.actual, cs.expected) {
+			t.Errorf("case %d: expected %v, actual %v", i, cs.expected, cs.actual)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package winny
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// HostResolver resolves DDNS host names of Winny nodes.
+// Servent uses net.LookupIP if no resolver is specified.
+type HostResolver interface {
+	LookupIP(host string) ([]net.IP, error)
+}
+
+type netResolver struct{}
+
+func (r netResolver) LookupIP(host string) ([]net.IP, error) {
+	return net.LookupIP(host)
+}
+
+// Interval to resolve DDNS host names again.
+// The addresses of DDNS nodes are expected to change at most a few times a day.
+const ddnsRefreshInterval = 10 * time.Minute
+
+// Maximum number of the tracked DDNS host names.
+// Only the names given by AddNode are tracked, but the node lists may be large.
+const maxDdnsNodes = 1024
+
+// ddnsNode is a node known by its DDNS host name.
+// The resolved address is cached and refreshed periodically so that
+// the node can be reconnected even after its IP address changes.
+type ddnsNode struct {
+	Host string
+	Port int
+
+	// Last resolved address. Zero until the first resolution succeeds.
+	Addr     nodeAddr
+	Resolved bool
+	Expires  time.Time
+
+	resolving bool
+}
+
+type resolvedHost struct {
+	Key  string
+	Addr nodeAddr
+	Err  error
+}
+
+func ddnsKey(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+func (m *nodeMgr) resolver() HostResolver {
+	if m.servent.Resolver != nil {
+		return m.servent.Resolver
+	}
+	return netResolver{}
+}
+
+// addDdnsNode starts tracking the node with the DDNS host name.
+func (m *nodeMgr) addDdnsNode(host string, port int) {
+	key := ddnsKey(host, port)
+	if m.ddnsNodes[key] != nil {
+		return
+	}
+	if len(m.ddnsNodes) >= maxDdnsNodes {
+		log.Println("too many DDNS nodes; ignored " + host)
+		return
+	}
+
+	n := &ddnsNode{Host: host, Port: port}
+	m.ddnsNodes[key] = n
+	m.resolve(key, n)
+}
+
+// resolve looks up the host name in another goroutine
+// and reports the result to the resolved channel.
+func (m *nodeMgr) resolve(key string, n *ddnsNode) {
+	n.resolving = true
+
+	resolver := m.resolver()
+	host := n.Host
+	port := n.Port
+
+	go func() {
+		r := &resolvedHost{Key: key}
+
+		ips, err := resolver.LookupIP(host)
+		if err == nil {
+			err = errors.New("no IPv4 address for the host: " + host)
+			for _, ip := range ips {
+				if ip4 := ip.To4(); ip4 != nil {
+					copy(r.Addr.IP[:], ip4)
+					r.Addr.Port = port
+					err = nil
+					break
+				}
+			}
+		}
+		r.Err = err
+
+		m.resolved <- r
+	}()
+}
+
+func (m *nodeMgr) updateResolved(r *resolvedHost) {
+	n := m.ddnsNodes[r.Key]
+	if n == nil {
+		return
+	}
+	n.resolving = false
+	n.Expires = time.Now().Add(ddnsRefreshInterval)
+
+	if r.Err != nil {
+		log.Println(r.Err)
+		return
+	}
+
+	if isPrivateIP(r.Addr.IP[:]) || m.isRefused(r.Addr.IP) {
+		return
+	}
+
+	// Move the node information to the new address if the IP address has changed.
+	info := m.nodes[r.Addr]
+	if n.Resolved && n.Addr != r.Addr {
+		prevInfo := m.nodes[n.Addr]
+		if prevInfo != nil && prevInfo.Ddns == n.Host {
+			delete(m.nodes, n.Addr)
+			if info == nil {
+				info = prevInfo
+			}
+		}
+	}
+
+	n.Addr = r.Addr
+	n.Resolved = true
+
+	// Add the node again if it is forgotten so that the servent can reconnect to it.
+	if info == nil {
+		info = &nodeInfo{}
+	}
+	info.Ddns = n.Host
+	m.nodes[r.Addr] = info
+}
+
+// setDdnsAddr records the address of the node whose DDNS host name is reported by the node itself.
+// Names reported by the nodes are not tracked unless they are also given by AddNode,
+// so that the nodes cannot make the servent resolve arbitrary host names.
+func (m *nodeMgr) setDdnsAddr(host string, addr nodeAddr) {
+	n := m.ddnsNodes[ddnsKey(host, addr.Port)]
+	if n == nil {
+		return
+	}
+	n.Addr = addr
+	n.Resolved = true
+	n.Expires = time.Now().Add(ddnsRefreshInterval)
+}
+
+// refreshDdnsNodes resolves the expired DDNS host names again.
+func (m *nodeMgr) refreshDdnsNodes() {
+	now := time.Now()
+	for key, n := range m.ddnsNodes {
+		if n.resolving || now.Before(n.Expires) {
+			continue
+		}
+		m.resolve(key, n)
+	}
+}
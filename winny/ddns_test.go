@@ -0,0 +1,61 @@
+package winny
+
+import (
+	"net"
+	"strconv"
+	"testing"
+)
+
+type fakeResolver map[string]net.IP
+
+func (r fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	return []net.IP{r[host]}, nil
+}
+
+func TestDdnsNode(t *testing.T) {
+	resolver := fakeResolver{"pl369.nas81a.p-ibaraki.nttpc.ne.jp": net.ParseIP("49.253.181.126")}
+	m := newNodeMgr(&Servent{Resolver: resolver})
+
+	m.addNodeStr("@f730cabc6e05837cd87bca1352df0545adc8863b59527bcd10210d7154c205e0c51b2b71548d5bdac5")
+	m.updateResolved(<-m.resolved)
+
+	first := nodeAddr{IP: [4]byte{49, 253, 181, 126}, Port: 22739}
+	info := m.nodes[first]
+	if info == nil || info.Ddns != "pl369.nas81a.p-ibaraki.nttpc.ne.jp" {
+		t.Fatalf("DDNS node not added: %#v", m.nodes)
+	}
+
+	// The IP address of the node changes
+	resolver["pl369.nas81a.p-ibaraki.nttpc.ne.jp"] = net.ParseIP("111.249.228.239")
+	for key, n := range m.ddnsNodes {
+		m.resolve(key, n)
+	}
+	m.updateResolved(<-m.resolved)
+
+	second := nodeAddr{IP: [4]byte{111, 249, 228, 239}, Port: 22739}
+	if m.nodes[first] != nil {
+		t.Errorf("old address remains: %#v", m.nodes)
+	}
+	if m.nodes[second] != info {
+		t.Errorf("node information not moved: %#v", m.nodes)
+	}
+}
+
+func TestDdnsNodeReportedByPeer(t *testing.T) {
+	m := newNodeMgr(&Servent{Resolver: fakeResolver{}})
+
+	// Names reported by the nodes themselves are not tracked nor resolved.
+	m.setDdnsAddr("attacker.example.com", nodeAddr{IP: [4]byte{1, 2, 3, 4}, Port: 1})
+	if len(m.ddnsNodes) != 0 {
+		t.Errorf("reported DDNS name is tracked: %#v", m.ddnsNodes)
+	}
+
+	for i := 0; i < maxDdnsNodes; i++ {
+		host := "host" + strconv.Itoa(i)
+		m.ddnsNodes[ddnsKey(host, 1)] = &ddnsNode{Host: host, Port: 1}
+	}
+	m.addDdnsNode("overflow.example.com", 1)
+	if len(m.ddnsNodes) != maxDdnsNodes {
+		t.Errorf("expected %d DDNS nodes, actual %d", maxDdnsNodes, len(m.ddnsNodes))
+	}
+}
@@ -0,0 +1,59 @@
+package winny
+
+import (
+	"github.com/peryaudo/goony/winny/proto"
+	"time"
+)
+
+// The same query is considered a duplicate within the window.
+const queryDedupWindow = 5 * time.Minute
+
+// queryOrigin identifies a query in the network.
+// Query ids are chosen by the origin node, so they are unique only with the origin.
+type queryOrigin struct {
+	Id     uint32
+	Origin nodeAddr
+}
+
+// queryDedup remembers the queries seen recently.
+// The same query reaches the servent through multiple peers, and seeing it twice means
+// it has been reported to the keyword streams already.
+// The servent does not relay received queries yet; the relay should consult it
+// as well to avoid forwarding loops once it is implemented.
+type queryDedup struct {
+	window time.Duration
+	seen   map[queryOrigin]time.Time
+}
+
+func newQueryDedup(window time.Duration) *queryDedup {
+	return &queryDedup{
+		window: window,
+		seen:   make(map[queryOrigin]time.Time)}
+}
+
+// originOf returns the origin of the query.
+// The first node in the path is the origin; a query without the path originates from the sender.
+func originOf(recvCmd *recvCmd) queryOrigin {
+	query := recvCmd.cmd.(*proto.Query)
+	origin := recvCmd.From
+	if len(query.Nodes) > 0 {
+		origin = query.Nodes[0]
+	}
+	return queryOrigin{Id: query.Id, Origin: origin}
+}
+
+// Seen records the query and returns true if it has been seen within the window.
+func (d *queryDedup) Seen(q queryOrigin, now time.Time) bool {
+	last, ok := d.seen[q]
+	d.seen[q] = now
+	return ok && now.Sub(last) < d.window
+}
+
+// Prune forgets the queries older than the window.
+func (d *queryDedup) Prune(now time.Time) {
+	for q, last := range d.seen {
+		if now.Sub(last) >= d.window {
+			delete(d.seen, q)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package winny
+
+import (
+	"github.com/peryaudo/goony/winny/proto"
+	"testing"
+	"time"
+)
+
+func TestQueryDedup(t *testing.T) {
+	d := newQueryDedup(time.Minute)
+
+	origin := nodeAddr{IP: [4]byte{1, 1, 1, 1}, Port: 1}
+	viaA := &recvCmd{From: nodeAddr{IP: [4]byte{2, 2, 2, 2}}, cmd: &proto.Query{Id: 1, Nodes: []nodeAddr{origin}}}
+	viaB := &recvCmd{From: nodeAddr{IP: [4]byte{3, 3, 3, 3}}, cmd: &proto.Query{Id: 1, Nodes: []nodeAddr{origin}}}
+	other := &recvCmd{From: nodeAddr{IP: [4]byte{2, 2, 2, 2}}, cmd: &proto.Query{Id: 1}}
+
+	now := time.Now()
+	if d.Seen(originOf(viaA), now) {
+		t.Error("first query is a duplicate")
+	}
+	if !d.Seen(originOf(viaB), now) {
+		t.Error("same query through another peer is not a duplicate")
+	}
+	if d.Seen(originOf(other), now) {
+		t.Error("same id from another origin is a duplicate")
+	}
+
+	d.Prune(now.Add(2 * time.Minute))
+	if d.Seen(originOf(viaA), now.Add(2*time.Minute)) {
+		t.Error("query outside the window is a duplicate")
+	}
+}
@@ -0,0 +1,93 @@
+package winny
+
+import (
+	"github.com/peryaudo/goony/winny/proto"
+	"time"
+)
+
+// This file implements flood protection against abusive or buggy peers.
+
+const (
+	// Each connection may send cmdRate commands per second on average
+	// and cmdBurst commands at once.
+	cmdRate  = 20
+	cmdBurst = 200
+
+	// The connection is closed after the peer exceeded the rate limit
+	// maxDroppedCmds times within dropWindow, even if some commands are allowed in between.
+	maxDroppedCmds = 600
+	dropWindow     = 60 * time.Second
+
+	// Length of the buffers between the nodes and the dispatcher.
+	recvCmdBufLen = 256
+
+	// Addr commands of unknown nodes are ignored while the node list has maxKnownNodes entries,
+	// so that peers cannot grow it without limit.
+	maxKnownNodes = 4096
+)
+
+// tokenBucket is a token bucket rate limiter.
+// It is not safe for concurrent use; each connection owns its own.
+type tokenBucket struct {
+	Rate  float64 // tokens per second
+	Burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		Rate:   rate,
+		Burst:  burst,
+		tokens: burst,
+		last:   time.Now()}
+}
+
+// Allow consumes a token and returns true if one is available.
+func (b *tokenBucket) Allow() bool {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.Rate
+	if b.tokens > b.Burst {
+		b.tokens = b.Burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// dropCounter counts the commands dropped by the rate limit within fixed windows.
+// It is not safe for concurrent use; each connection owns its own.
+type dropCounter struct {
+	Window time.Duration
+	Max    int
+
+	count int
+	start time.Time
+}
+
+// Add records a dropped command at now and returns true if the peer dropped
+// Max commands within the current window.
+func (d *dropCounter) Add(now time.Time) bool {
+	if now.Sub(d.start) >= d.Window {
+		d.start = now
+		d.count = 0
+	}
+	d.count++
+	return d.count >= d.Max
+}
+
+// isControlCmd reports whether the command is exempt from the rate limit.
+// Closing commands are sent at most once per connection and must not be lost.
+func isControlCmd(c cmd) bool {
+	switch c.(type) {
+	case *proto.Close, *proto.CloseTransLimit, *proto.CloseBadPort0,
+		*proto.CloseIgnored, *proto.CloseSlow, *proto.CloseForgery:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package winny
+
+import (
+	"bytes"
+	"github.com/peryaudo/goony/winny/proto"
+	"testing"
+	"time"
+)
+
+func TestDropCounter(t *testing.T) {
+	d := &dropCounter{Window: time.Minute, Max: 3}
+	now := time.Unix(1000, 0)
+
+	// Drops spread across the windows never reach the limit.
+	for i := 0; i < 10; i++ {
+		if d.Add(now.Add(time.Duration(i) * 30 * time.Second)) {
+			t.Fatalf("drop %d: banned a peer under the limit", i)
+		}
+	}
+
+	// Allowed commands in between do not reset the count within the window.
+	now = now.Add(time.Hour)
+	if d.Add(now) || d.Add(now.Add(time.Second)) {
+		t.Fatal("banned a peer under the limit")
+	}
+	if !d.Add(now.Add(2 * time.Second)) {
+		t.Error("the peer exceeding the limit is not banned")
+	}
+}
+
+func TestIsControlCmd(t *testing.T) {
+	if !isControlCmd(&proto.Close{}) || !isControlCmd(&proto.CloseForgery{}) {
+		t.Error("control commands are rate limited")
+	}
+	if isControlCmd(&proto.Query{}) || isControlCmd(&proto.Spread{}) || isControlCmd(&proto.Addr{}) {
+		t.Error("ordinary commands are exempt from the rate limit")
+	}
+}
+
+func TestFloodAddr(t *testing.T) {
+	var buf bytes.Buffer
+	for i := 0; i < cmdBurst+maxDroppedCmds+100; i++ {
+		addr := &proto.Addr{IP: [4]byte{1, 1, byte(i >> 8), byte(i)}, Port: 1}
+		if err := proto.Encode(&buf, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Servent{recvCmd: make(chan *recvCmd, cmdBurst+maxDroppedCmds+100)}
+	m := newNodeMgr(s)
+	m.closed = make(chan *closedConn, 1)
+	c := &nodeConn{mgr: m, framer: proto.NewFramer(&buf, nil)}
+	c.recvLoop()
+
+	select {
+	case cls := <-m.closed:
+		if !cls.Ban {
+			t.Errorf("flooding peer is not banned: %v", cls.Reason)
+		}
+	default:
+		t.Fatal("connection is not closed")
+	}
+	if len(s.recvCmd) > cmdBurst+1 {
+		t.Errorf("%d Addr commands passed the rate limit", len(s.recvCmd))
+	}
+}
+
+func TestMaxKnownNodes(t *testing.T) {
+	m := newNodeMgr(&Servent{})
+	for i := 0; i < maxKnownNodes+10; i++ {
+		m.addNode(&proto.Addr{IP: [4]byte{1, byte(i >> 16), byte(i >> 8), byte(i)}, Port: 1})
+	}
+	if len(m.nodes) != maxKnownNodes {
+		t.Errorf("expected %d nodes, actual %d", maxKnownNodes, len(m.nodes))
+	}
+}
@@ -0,0 +1,110 @@
+package winny
+
+import (
+	"errors"
+	"fmt"
+	"github.com/peryaudo/goony/winny/proto"
+	"log"
+	"net"
+	"time"
+)
+
+// This file implements heuristics to detect forged file keys.
+// Forged keys are dropped, and the nodes repeatedly creating them are disconnected by cmdCloseForgery and banned.
+// Relaying nodes are never punished because they only pass the keys of others through.
+
+const (
+	// Winny keys live 1500 seconds at most.
+	maxKeyTtl = 1500
+
+	// Timestamps before the first release of Winny are impossible.
+	minKeyTimestamp = 1020643200 // 2002-05-06
+
+	// Tolerance for clock differences between the nodes.
+	keyTimestampTolerance = 24 * time.Hour
+
+	// A node is disconnected after it sent forged keys forgeryThreshold times within forgeryWindow.
+	forgeryThreshold = 3
+	forgeryWindow    = 10 * time.Minute
+)
+
+type forgeryOffense struct {
+	Count int
+	Since time.Time
+}
+
+// checkForgery returns an error describing the reason if the key looks forged.
+func (m *queryMgr) checkForgery(k *FileKey) error {
+	if k.Ttl > maxKeyTtl {
+		return errors.New(fmt.Sprintf("bogus TTL: %d", k.Ttl))
+	}
+
+	timestamp := time.Unix(int64(k.Timestamp), 0)
+	if k.Timestamp < minKeyTimestamp || timestamp.After(time.Now().Add(keyTimestampTolerance)) {
+		return errors.New(fmt.Sprintf("impossible timestamp: %v", timestamp))
+	}
+
+	// Keys announced by nodes on the network must carry addresses reachable from it.
+	ip := net.IP(k.Node.IP[:])
+	if ip.IsUnspecified() || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		m.servent.Blocklist.Contains(ip) {
+		return errors.New(fmt.Sprintf("invalid node address: %v", ip))
+	}
+
+	return nil
+}
+
+// filterKeys returns the keys of the query that are neither forged nor conflicting with the known keys.
+// forgery is the reason if the sender created a forged key by itself.
+func (m *queryMgr) filterKeys(recvCmd *recvCmd) (keys []FileKey, forgery error) {
+	query := recvCmd.cmd.(*proto.Query)
+
+	keys = make([]FileKey, 0, len(query.Keys))
+	for i := range query.Keys {
+		k := &query.Keys[i]
+		if err := m.checkForgery(k); err != nil {
+			if k.Node.IP == recvCmd.From.IP {
+				forgery = err
+			}
+			continue
+		}
+
+		// The size seen first may be the forged one, so the conflicting key is dropped
+		// without blaming anyone.
+		if prev := m.keys.Get(k.Hash); prev != nil && prev.Size != k.Size {
+			continue
+		}
+
+		keys = append(keys, *k)
+	}
+	return
+}
+
+// reportForgery counts the offense of the node
+// and disconnects it if it has sent forged keys repeatedly.
+func (m *queryMgr) reportForgery(from nodeAddr, reason error) {
+	log.Printf("forged key from %s: %v\n", net.IP(from.IP[:]), reason)
+
+	o := m.forgeryOffenses[from.IP]
+	if o == nil || time.Since(o.Since) > forgeryWindow {
+		o = &forgeryOffense{Since: time.Now()}
+		m.forgeryOffenses[from.IP] = o
+	}
+	o.Count++
+
+	if o.Count < forgeryThreshold {
+		return
+	}
+	delete(m.forgeryOffenses, from.IP)
+
+	m.servent.nodeMgr.Ban <- &banReq{Addr: from, Notice: &proto.CloseForgery{}}
+}
+
+// pruneForgeryOffenses forgets the offenses older than the window.
+func (m *queryMgr) pruneForgeryOffenses() {
+	for ip, o := range m.forgeryOffenses {
+		if time.Since(o.Since) > forgeryWindow {
+			delete(m.forgeryOffenses, ip)
+		}
+	}
+}
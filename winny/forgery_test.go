@@ -0,0 +1,115 @@
+package winny
+
+import (
+	"github.com/peryaudo/goony/winny/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckForgery(t *testing.T) {
+	m := newQueryMgr(&Servent{})
+
+	genuine := FileKey{
+		Node:      nodeAddr{IP: [4]byte{118, 106, 156, 95}, Port: 7743},
+		Size:      0x234db804,
+		Hash:      [16]byte{0x2a, 0x66, 0x62, 0x44},
+		Ttl:       532,
+		Timestamp: uint32(time.Now().Unix())}
+	if err := m.checkForgery(&genuine); err != nil {
+		t.Fatalf("genuine key flagged: %v", err)
+	}
+	m.keys.Add(&genuine)
+
+	forgeries := []func(k *FileKey){
+		func(k *FileKey) { k.Ttl = 60000 },
+		func(k *FileKey) { k.Timestamp = 100 },
+		func(k *FileKey) { k.Timestamp = uint32(time.Now().Add(72 * time.Hour).Unix()) },
+		func(k *FileKey) { k.Node.IP = [4]byte{192, 168, 0, 2} },
+		func(k *FileKey) { k.Node.IP = [4]byte{} },
+		func(k *FileKey) { k.Node.IP = [4]byte{10, 1, 2, 3} },
+		func(k *FileKey) { k.Node.IP = [4]byte{172, 20, 0, 1} },
+		func(k *FileKey) { k.Node.IP = [4]byte{127, 0, 0, 1} },
+		func(k *FileKey) { k.Node.IP = [4]byte{169, 254, 1, 1} },
+	}
+	for i, forge := range forgeries {
+		k := genuine
+		forge(&k)
+		if err := m.checkForgery(&k); err == nil {
+			t.Errorf("forgery %d not detected: %#v", i, k)
+		}
+	}
+}
+
+func TestFilterKeys(t *testing.T) {
+	m := newQueryMgr(&Servent{})
+
+	creator := nodeAddr{IP: [4]byte{118, 106, 156, 95}, Port: 7743}
+	relay := nodeAddr{IP: [4]byte{60, 1, 2, 3}, Port: 80}
+	genuine := FileKey{
+		Node:      creator,
+		Size:      0x234db804,
+		Hash:      [16]byte{0x2a, 0x66, 0x62, 0x44},
+		Ttl:       532,
+		Timestamp: uint32(time.Now().Unix())}
+	m.keys.Add(&genuine)
+
+	conflicting := genuine
+	conflicting.Size++
+	forged := genuine
+	forged.Hash[0]++
+	forged.Ttl = 60000
+
+	cases := []struct {
+		from    nodeAddr
+		key     FileKey
+		kept    int
+		forgery bool
+	}{
+		{creator, genuine, 1, false},
+		// The size seen first is not trusted enough to blame the sender.
+		{creator, conflicting, 0, false},
+		{creator, forged, 0, true},
+		// Relays are not blamed for the keys of others.
+		{relay, forged, 0, false}}
+	for i, c := range cases {
+		recvCmd := &recvCmd{From: c.from, cmd: &proto.Query{Keys: []FileKey{c.key}}}
+		keys, forgery := m.filterKeys(recvCmd)
+		if len(keys) != c.kept || (forgery != nil) != c.forgery {
+			t.Errorf("case %d: expected %d keys and forgery %v, actual %d keys and %v",
+				i, c.kept, c.forgery, len(keys), forgery)
+		}
+	}
+}
+
+func TestBanSendsCloseForgery(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	m := newNodeMgr(&Servent{})
+	addr := nodeAddr{IP: [4]byte{1, 1, 1, 1}, Port: 1}
+	c := newNodeConn(local, addr, false, m)
+	m.connNodes[addr] = c
+	go c.writeLoop()
+
+	m.ban(addr, &proto.CloseForgery{})
+
+	framer := proto.NewFramer(remote, nil)
+	idx, payload, err := framer.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd, err := proto.Parse(idx, payload); err != nil {
+		t.Fatal(err)
+	} else if _, ok := cmd.(*proto.CloseForgery); !ok {
+		t.Fatalf("unexpected command %T", cmd)
+	}
+
+	// The connection is closed after the notice.
+	if _, _, err := framer.ReadFrame(); err == nil {
+		t.Error("connection is not closed")
+	}
+	if !m.bans.IsBanned(addr.IP) {
+		t.Error("node is not banned")
+	}
+}
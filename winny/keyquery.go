@@ -0,0 +1,273 @@
+package winny
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// KeySortOrder is the order of the keys returned by Servent.QueryKeys.
+type KeySortOrder int
+
+const (
+	SortByFirstSeen KeySortOrder = iota
+	SortByLastSeen
+	SortByRefCnt
+	SortBySize
+)
+
+// Default and maximum number of keys in a page.
+const (
+	defaultKeyQueryLimit = 100
+	maxKeyQueryLimit     = 10000
+)
+
+// KeyQuery filters, sorts and paginates the known keys.
+// Zero fields impose no conditions.
+type KeyQuery struct {
+	// Matches the file keys. nil matches all the keys.
+	Query *Query
+
+	// Ranges of the times the keys were first and last seen.
+	// After is inclusive and Before is exclusive.
+	FirstSeenAfter  time.Time
+	FirstSeenBefore time.Time
+	LastSeenAfter   time.Time
+	LastSeenBefore  time.Time
+
+	MinRefCnt uint32
+
+	SortBy     KeySortOrder
+	Descending bool
+
+	// Maximum number of the keys in the page. Defaults to 100.
+	Limit int
+	// NextCursor of the previous page to get the next page.
+	// It must be used with the same SortBy and Descending.
+	Cursor string
+}
+
+// KeyPage is a page of the keys returned by Servent.QueryKeys.
+type KeyPage struct {
+	Keys []*AggregatedKey
+	// Cursor to get the next page. Empty if this is the last page.
+	NextCursor string
+}
+
+type keyQueryReq struct {
+	KeyQuery
+	Results chan *keyQueryResult
+
+	scan *keyScan
+}
+
+type keyQueryResult struct {
+	Page *KeyPage
+	Err  error
+}
+
+// keyCursor is the position of the last key in the page.
+// Keys are ordered by the sort value and then by the id, so the position is stable
+// even when new keys are added between the pages. The sort values of SortByLastSeen
+// and SortByRefCnt change as the keys are seen again, and such keys may be
+// skipped or returned again in the later pages.
+//
+// The cursor also records the order it was made for, and it is refused by the
+// queries with another order.
+type keyCursor struct {
+	SortBy     KeySortOrder
+	Descending bool
+	Value      int64
+	Id         uint32
+}
+
+const keyCursorLen = 14
+
+func (c keyCursor) String() string {
+	var b [keyCursorLen]byte
+	b[0] = byte(c.SortBy)
+	if c.Descending {
+		b[1] = 1
+	}
+	binary.BigEndian.PutUint64(b[2:10], uint64(c.Value))
+	binary.BigEndian.PutUint32(b[10:14], c.Id)
+	return base64.RawURLEncoding.EncodeToString(b[:])
+}
+
+func parseKeyCursor(s string) (c keyCursor, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) != keyCursorLen || b[1] > 1 {
+		err = errors.New("invalid cursor: " + s)
+		return
+	}
+	c.SortBy = KeySortOrder(b[0])
+	c.Descending = b[1] == 1
+	c.Value = int64(binary.BigEndian.Uint64(b[2:10]))
+	c.Id = binary.BigEndian.Uint32(b[10:14])
+	return
+}
+
+// less reports whether a precedes b in the order of the cursors.
+func (c keyCursor) less(a, b keyCursor) bool {
+	if a.Value != b.Value {
+		return (a.Value < b.Value) != c.Descending
+	}
+	if a.Id != b.Id {
+		return (a.Id < b.Id) != c.Descending
+	}
+	return false
+}
+
+// keyHeap keeps the first keys in the order with the last one of them at the top.
+type keyHeap struct {
+	order keyCursor
+	keys  []keyCursor
+}
+
+func (h *keyHeap) Len() int           { return len(h.keys) }
+func (h *keyHeap) Less(i, j int) bool { return h.order.less(h.keys[j], h.keys[i]) }
+func (h *keyHeap) Swap(i, j int)      { h.keys[i], h.keys[j] = h.keys[j], h.keys[i] }
+func (h *keyHeap) Push(x interface{}) { h.keys = append(h.keys, x.(keyCursor)) }
+func (h *keyHeap) Pop() (x interface{}) {
+	x = h.keys[len(h.keys)-1]
+	h.keys = h.keys[:len(h.keys)-1]
+	return
+}
+
+// sortValue returns the value of the key to sort by.
+func (s *keyStore) sortValue(id uint32, order KeySortOrder) int64 {
+	agg := s.aggs[id]
+	switch order {
+	case SortByLastSeen:
+		return agg.LastSeen.UnixNano()
+	case SortByRefCnt:
+		return int64(agg.MaxRefCnt)
+	case SortBySize:
+		return int64(s.keys[id].Size)
+	default:
+		return agg.FirstSeen.UnixNano()
+	}
+}
+
+// Query returns a page of the keys satisfying the conditions.
+// Only the keys in the page are kept while scanning, so that large stores can be paged cheaply.
+func (s *keyStore) Query(kq *KeyQuery) (page *KeyPage, err error) {
+	scan, err := s.newKeyScan(kq)
+	if err != nil {
+		return
+	}
+	for !s.scanKeys(scan, math.MaxInt) {
+	}
+	return s.keyPage(scan), nil
+}
+
+// keyScan is the progress of a Query, which may be done in batches between other requests.
+type keyScan struct {
+	*KeyQuery
+
+	limit int
+	order keyCursor
+	after *keyCursor // nil for the first page
+
+	// One more key than the limit tells whether there is the next page.
+	heap *keyHeap
+	next uint32
+}
+
+func (s *keyStore) newKeyScan(kq *KeyQuery) (scan *keyScan, err error) {
+	limit := kq.Limit
+	if limit <= 0 {
+		limit = defaultKeyQueryLimit
+	}
+	if limit > maxKeyQueryLimit {
+		limit = maxKeyQueryLimit
+	}
+
+	order := keyCursor{SortBy: kq.SortBy, Descending: kq.Descending}
+	scan = &keyScan{
+		KeyQuery: kq,
+		limit:    limit,
+		order:    order,
+		heap:     &keyHeap{order: order, keys: make([]keyCursor, 0, limit+1)}}
+
+	if len(kq.Cursor) > 0 {
+		var c keyCursor
+		c, err = parseKeyCursor(kq.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if c.SortBy != kq.SortBy || c.Descending != kq.Descending {
+			return nil, errors.New("cursor used with another sort order")
+		}
+		scan.after = &c
+	}
+	return
+}
+
+// scanKeys scans at most max keys matching the query and returns true if all the keys are scanned.
+func (s *keyStore) scanKeys(scan *keyScan, max int) (done bool) {
+	h := scan.heap
+	done = true
+	s.searchIdsFrom(scan.Query, scan.next, func(id uint32) bool {
+		if max <= 0 {
+			scan.next = id
+			done = false
+			return false
+		}
+		max--
+
+		if !scan.matchAggregate(s.aggs[id]) {
+			return true
+		}
+		c := keyCursor{SortBy: scan.SortBy, Descending: scan.Descending, Value: s.sortValue(id, scan.SortBy), Id: id}
+		if scan.after != nil && !scan.order.less(*scan.after, c) {
+			return true
+		}
+		if h.Len() <= scan.limit {
+			heap.Push(h, c)
+		} else if scan.order.less(c, h.keys[0]) {
+			h.keys[0] = c
+			heap.Fix(h, 0)
+		}
+		return true
+	})
+	return
+}
+
+// keyPage returns the page of the scanned keys.
+func (s *keyStore) keyPage(scan *keyScan) (page *KeyPage) {
+	h := scan.heap
+	matched := make([]keyCursor, h.Len())
+	for i := len(matched) - 1; i >= 0; i-- {
+		matched[i] = heap.Pop(h).(keyCursor)
+	}
+
+	page = &KeyPage{Keys: make([]*AggregatedKey, 0)}
+	if len(matched) > scan.limit {
+		matched = matched[:scan.limit]
+		page.NextCursor = matched[scan.limit-1].String()
+	}
+	for _, c := range matched {
+		page.Keys = append(page.Keys, s.aggs[c.Id].snapshot(s.keys[c.Id]))
+	}
+	return
+}
+
+func (kq *KeyQuery) matchAggregate(agg *keyAggregate) bool {
+	if !kq.FirstSeenAfter.IsZero() && agg.FirstSeen.Before(kq.FirstSeenAfter) {
+		return false
+	}
+	if !kq.FirstSeenBefore.IsZero() && !agg.FirstSeen.Before(kq.FirstSeenBefore) {
+		return false
+	}
+	if !kq.LastSeenAfter.IsZero() && agg.LastSeen.Before(kq.LastSeenAfter) {
+		return false
+	}
+	if !kq.LastSeenBefore.IsZero() && !agg.LastSeen.Before(kq.LastSeenBefore) {
+		return false
+	}
+	return agg.MaxRefCnt >= kq.MinRefCnt
+}
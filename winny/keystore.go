@@ -0,0 +1,334 @@
+package winny
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// keyStore stores file keys with indexes for fast searches.
+// Keys are identified by sequential ids in the order of insertion,
+// so that every posting list is sorted without extra work.
+// It is not safe for concurrent use; the query manager owns it.
+type keyStore struct {
+	keys  []*FileKey
+	names []string // file names normalized by DefaultNormalization
+	aggs  []*keyAggregate
+
+	// Hash index
+	ids map[[16]byte]uint32
+
+	// Bigram index over the normalized file names
+	grams map[string][]uint32
+
+	// Size index bucketed by the bit length of the size
+	sizes [33][]uint32
+}
+
+func newKeyStore() *keyStore {
+	return &keyStore{
+		ids:   make(map[[16]byte]uint32),
+		grams: make(map[string][]uint32)}
+}
+
+// Returns the number of the keys.
+func (s *keyStore) Len() int {
+	return len(s.keys)
+}
+
+// Returns the key with the hash, or nil if there's none.
+func (s *keyStore) Get(hash [16]byte) *FileKey {
+	id, ok := s.ids[hash]
+	if !ok {
+		return nil
+	}
+	return s.keys[id]
+}
+
+// Returns the file name of the key normalized by DefaultNormalization.
+func (s *keyStore) Name(id uint32) string {
+	return s.names[id]
+}
+
+// Returns the aggregated announcements of the key with the hash, or nil if there's none.
+func (s *keyStore) Aggregate(hash [16]byte) *AggregatedKey {
+	id, ok := s.ids[hash]
+	if !ok {
+		return nil
+	}
+	return s.aggs[id].snapshot(s.keys[id])
+}
+
+// Adds the key and returns its id.
+// added is false if the key with the same hash already exists,
+// in which case the announcement is merged into the existing one.
+func (s *keyStore) Add(k *FileKey) (id uint32, added bool) {
+	now := time.Now()
+
+	if id, ok := s.ids[k.Hash]; ok {
+		s.aggs[id].update(k, now)
+		return id, false
+	}
+
+	id = uint32(len(s.keys))
+	name := DefaultNormalization.Apply(k.FileName)
+	s.keys = append(s.keys, k)
+	s.names = append(s.names, name)
+	s.aggs = append(s.aggs, newKeyAggregate(k, now))
+	s.ids[k.Hash] = id
+
+	for _, gram := range bigrams(name) {
+		postings := s.grams[gram]
+		// The same bigram may appear twice in a name.
+		if len(postings) > 0 && postings[len(postings)-1] == id {
+			continue
+		}
+		s.grams[gram] = append(postings, id)
+	}
+
+	bucket := bits.Len32(k.Size)
+	s.sizes[bucket] = append(s.sizes[bucket], id)
+	return id, true
+}
+
+// Calls fn for each key matching the query until fn returns false.
+func (s *keyStore) Search(q *Query, fn func(k *FileKey) bool) {
+	s.searchIds(q, func(id uint32) bool {
+		return fn(s.keys[id])
+	})
+}
+
+// searchIds calls fn with the id of each key matching the query
+// in the ascending order until fn returns false. nil matches all the keys.
+func (s *keyStore) searchIds(q *Query, fn func(id uint32) bool) {
+	s.searchIdsFrom(q, 0, fn)
+}
+
+// Same as searchIds, but skips the keys whose ids are less than start.
+func (s *keyStore) searchIdsFrom(q *Query, start uint32, fn func(id uint32) bool) {
+	var ids []uint32
+	indexed := false
+	if q != nil {
+		ids, indexed = s.candidates(q)
+	}
+	if !indexed {
+		for id := int(start); id < len(s.keys); id++ {
+			if (q == nil || q.matchNormalized(s.keys[id], s.names[id])) && !fn(uint32(id)) {
+				return
+			}
+		}
+		return
+	}
+
+	i := sort.Search(len(ids), func(i int) bool { return ids[i] >= start })
+	for _, id := range ids[i:] {
+		if q.matchNormalized(s.keys[id], s.names[id]) && !fn(id) {
+			return
+		}
+	}
+}
+
+// Appends the aggregated announcements of at most max keys matching the query
+// to aggs, skipping the keys whose ids are less than start.
+// If more keys remain, next is the id to resume from and done is false.
+func (s *keyStore) SearchAggregated(q *Query, start uint32, max int, aggs []*AggregatedKey) (_ []*AggregatedKey, next uint32, done bool) {
+	done = true
+	s.searchIdsFrom(q, start, func(id uint32) bool {
+		if max <= 0 {
+			next = id
+			done = false
+			return false
+		}
+		aggs = append(aggs, s.aggs[id].snapshot(s.keys[id]))
+		max--
+		return true
+	})
+	return aggs, next, done
+}
+
+// candidates returns the sorted ids of the keys which may match the query.
+// indexed is false if the indexes cannot narrow down the keys.
+func (s *keyStore) candidates(q *Query) (ids []uint32, indexed bool) {
+	if q.re != nil {
+		return
+	}
+
+	for _, group := range q.groups {
+		groupIds, ok := s.groupCandidates(q, group)
+		if !ok {
+			continue
+		}
+		if !indexed {
+			ids = groupIds
+			indexed = true
+		} else {
+			ids = intersectIds(ids, groupIds)
+		}
+		if len(ids) == 0 {
+			return
+		}
+	}
+	return
+}
+
+// groupCandidates returns the union of the candidates of the terms in the OR group.
+// ok is false if any of the terms cannot use the indexes.
+func (s *keyStore) groupCandidates(q *Query, group []*queryTerm) (ids []uint32, ok bool) {
+	for _, t := range group {
+		termIds, termOk := s.termCandidates(q, t)
+		if !termOk {
+			return nil, false
+		}
+		ids = unionIds(ids, termIds)
+	}
+	return ids, true
+}
+
+func (s *keyStore) termCandidates(q *Query, t *queryTerm) (ids []uint32, ok bool) {
+	if t.negate {
+		return nil, false
+	}
+
+	switch t.kind {
+	case termHash:
+		if id, found := s.ids[t.hash]; found {
+			ids = []uint32{id}
+		}
+		return ids, true
+
+	case termSize:
+		lo, hi := sizeRange(t.sizeOp, t.size)
+		if lo > hi {
+			return nil, true
+		}
+		for b := bits.Len32(lo); b <= bits.Len32(hi); b++ {
+			ids = unionIds(ids, s.sizes[b])
+		}
+		return ids, true
+
+	case termText, termExt:
+		// The bigram index is built with the default normalization only.
+		if q.norm != DefaultNormalization {
+			return nil, false
+		}
+		text := t.text
+		if t.kind == termExt {
+			text = "." + text
+		}
+		grams := bigrams(text)
+		if len(grams) == 0 {
+			return nil, false
+		}
+		for i, gram := range grams {
+			if i == 0 {
+				ids = s.grams[gram]
+			} else {
+				ids = intersectIds(ids, s.grams[gram])
+			}
+			if len(ids) == 0 {
+				break
+			}
+		}
+		return ids, true
+	}
+
+	return nil, false
+}
+
+// sizeRange converts the size filter into the inclusive range of uint32 sizes.
+func sizeRange(op string, size uint64) (lo, hi uint32) {
+	lo, hi = 0, math.MaxUint32
+	clamp := func(n uint64) uint32 {
+		if n > math.MaxUint32 {
+			return math.MaxUint32
+		}
+		return uint32(n)
+	}
+
+	switch op {
+	case ">":
+		if size >= math.MaxUint32 {
+			return 1, 0
+		}
+		lo = uint32(size) + 1
+	case ">=":
+		if size > math.MaxUint32 {
+			return 1, 0
+		}
+		lo = uint32(size)
+	case "<":
+		if size == 0 {
+			return 1, 0
+		}
+		hi = clamp(size - 1)
+	case "<=":
+		hi = clamp(size)
+	default:
+		if size > math.MaxUint32 {
+			return 1, 0
+		}
+		lo, hi = uint32(size), uint32(size)
+	}
+	return
+}
+
+// bigrams returns the rune bigrams of the string.
+func bigrams(s string) []string {
+	runes := []rune(s)
+	if len(runes) < 2 {
+		return nil
+	}
+	grams := make([]string, 0, len(runes)-1)
+	for i := 0; i+1 < len(runes); i++ {
+		grams = append(grams, string(runes[i:i+2]))
+	}
+	return grams
+}
+
+// intersectIds returns the intersection of the sorted id lists.
+func intersectIds(a, b []uint32) []uint32 {
+	result := make([]uint32, 0)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+// unionIds returns the union of the sorted id lists.
+func unionIds(a, b []uint32) []uint32 {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	result := make([]uint32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	result = append(result, b[j:]...)
+	return result
+}
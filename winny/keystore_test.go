@@ -0,0 +1,243 @@
+package winny
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestKeyStoreSearch(t *testing.T) {
+	s := newKeyStore()
+
+	names := []string{
+		"[Goony] Albatross Vol.01.zip",
+		"[Goony] Albatross Vol.02.zip",
+		"[Gooney] アルバトロス 第01話.avi",
+		"ｱﾙﾊﾞﾄﾛｽ 第02話.mp4",
+		"albatross.jpg",
+		"a.zip"}
+	for i, name := range names {
+		k := &FileKey{FileName: name, Size: uint32(1) << uint(i*5), Hash: [16]byte{byte(i)}}
+		if _, added := s.Add(k); !added {
+			t.Fatalf("key %d not added", i)
+		}
+	}
+	if _, added := s.Add(&FileKey{FileName: "duplicate", Hash: [16]byte{0}}); added {
+		t.Error("duplicate hash added")
+	}
+
+	queries := []string{
+		"",
+		"albatross",
+		"あるばとろす",
+		"goony | gooney",
+		"albatross -vol.02",
+		"ext:zip",
+		"ext:zip a",
+		"size:>1KB",
+		"size:<=1MB albatross",
+		"size:=1",
+		"%01000000000000000000000000000000",
+		"第0 話"}
+	for _, str := range queries {
+		q, err := CompileQuery(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := make([]*FileKey, 0)
+		for _, k := range s.keys {
+			if q.Match(k) {
+				expected = append(expected, k)
+			}
+		}
+
+		actual := make([]*FileKey, 0)
+		s.Search(q, func(k *FileKey) bool {
+			actual = append(actual, k)
+			return true
+		})
+
+		if len(actual) != len(expected) {
+			t.Errorf("query %#v: expected %d keys, actual %d", str, len(expected), len(actual))
+			continue
+		}
+		for i := range actual {
+			if actual[i] != expected[i] {
+				t.Errorf("query %#v: key %d mismatch", str, i)
+			}
+		}
+	}
+}
+
+func TestKeyStoreAggregate(t *testing.T) {
+	s := newKeyStore()
+
+	hash := [16]byte{1}
+	announcements := []FileKey{
+		{Node: nodeAddr{IP: [4]byte{1, 1, 1, 1}, Port: 1}, Hash: hash, FileName: "first.zip", RefCnt: 3},
+		{Node: nodeAddr{IP: [4]byte{2, 2, 2, 2}, Port: 2}, Hash: hash, FileName: "second.zip", RefCnt: 10},
+		{Node: nodeAddr{IP: [4]byte{1, 1, 1, 1}, Port: 1}, Hash: hash, FileName: "first.zip", RefCnt: 5}}
+	for i := range announcements {
+		s.Add(&announcements[i])
+	}
+
+	agg := s.Aggregate(hash)
+	if agg == nil {
+		t.Fatal("aggregate not found")
+	}
+	if agg.FileName != "first.zip" || agg.MaxRefCnt != 10 {
+		t.Errorf("unexpected aggregate: %#v", agg)
+	}
+	if len(agg.FileNames) != 2 || agg.FileNames[1] != "second.zip" {
+		t.Errorf("unexpected file names: %#v", agg.FileNames)
+	}
+	if len(agg.Sources) != 2 || agg.Sources[0].Addr != "1.1.1.1:1" || agg.Sources[1].Addr != "2.2.2.2:2" {
+		t.Errorf("unexpected sources: %#v", agg.Sources)
+	}
+	if s.Aggregate([16]byte{2}) != nil {
+		t.Error("unknown hash found")
+	}
+}
+
+func TestKeyStoreAggregateLimits(t *testing.T) {
+	s := newKeyStore()
+
+	hash := [16]byte{1}
+	for i := 0; i < maxKeySources+maxKeyFileNames; i++ {
+		s.Add(&FileKey{
+			Node:     nodeAddr{IP: [4]byte{1, 1, byte(i >> 8), byte(i)}, Port: 1},
+			Hash:     hash,
+			FileName: fmt.Sprintf("file%d.zip", i)})
+	}
+
+	agg := s.Aggregate(hash)
+	if len(agg.FileNames) != maxKeyFileNames || agg.FileNames[maxKeyFileNames-1] != fmt.Sprintf("file%d.zip", maxKeyFileNames-1) {
+		t.Errorf("unexpected file names: %v", agg.FileNames)
+	}
+	if len(agg.Sources) != maxKeySources {
+		t.Errorf("expected %d sources, actual %d", maxKeySources, len(agg.Sources))
+	}
+}
+
+func TestKeyStoreSearchAggregated(t *testing.T) {
+	s := newKeyStore()
+	for i := 0; i < 10; i++ {
+		name := "foo.zip"
+		if i%2 == 1 {
+			name = "bar.zip"
+		}
+		s.Add(&FileKey{FileName: name, Hash: [16]byte{byte(i)}})
+	}
+
+	// nil matches all the keys, and the batches resume where the previous ones stopped.
+	cases := []struct {
+		query    string
+		expected int
+	}{{"", 10}, {"foo", 5}}
+	for _, c := range cases {
+		var q *Query
+		if len(c.query) > 0 {
+			q, _ = CompileQuery(c.query)
+		}
+
+		var aggs []*AggregatedKey
+		var next uint32
+		done := false
+		for batches := 0; !done; batches++ {
+			if batches > c.expected {
+				t.Fatalf("%q: aggregation does not finish", c.query)
+			}
+			aggs, next, done = s.SearchAggregated(q, next, 2, aggs)
+		}
+		if len(aggs) != c.expected {
+			t.Errorf("%q: expected %d keys, actual %d", c.query, c.expected, len(aggs))
+		}
+		for i := 1; i < len(aggs); i++ {
+			if aggs[i-1].Hash[0] >= aggs[i].Hash[0] {
+				t.Errorf("%q: keys are repeated or out of order", c.query)
+			}
+		}
+	}
+}
+
+func TestKeyStoreQuery(t *testing.T) {
+	s := newKeyStore()
+	for i := 0; i < 10; i++ {
+		s.Add(&FileKey{FileName: "file.zip", Hash: [16]byte{byte(i)}, RefCnt: uint32(i % 4), Size: uint32(i)})
+	}
+
+	// Top keys by RefCnt across the pages
+	kq := &KeyQuery{SortBy: SortByRefCnt, Descending: true, Limit: 4}
+	expected := []uint32{3, 3, 2, 2, 1, 1, 1, 0, 0, 0}
+	actual := make([]uint32, 0)
+	for {
+		page, err := s.Query(kq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range page.Keys {
+			actual = append(actual, k.MaxRefCnt)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		kq.Cursor = page.NextCursor
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %v, actual %v", expected, actual)
+	}
+	for i := range actual {
+		if actual[i] != expected[i] {
+			t.Fatalf("expected %v, actual %v", expected, actual)
+		}
+	}
+
+	// Filters
+	q, _ := CompileQuery("size:>=5")
+	page, err := s.Query(&KeyQuery{Query: q, MinRefCnt: 2, SortBy: SortBySize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Keys) != 2 || page.Keys[0].Size != 6 || page.Keys[1].Size != 7 {
+		t.Errorf("unexpected page: %#v", page.Keys)
+	}
+
+	page, err = s.Query(&KeyQuery{FirstSeenAfter: time.Now().Add(time.Hour)})
+	if err != nil || len(page.Keys) != 0 {
+		t.Errorf("unexpected page: %#v %v", page, err)
+	}
+
+	if _, err := s.Query(&KeyQuery{Cursor: "invalid"}); err == nil {
+		t.Error("invalid cursor accepted")
+	}
+
+	// Cursors are bound to the sort order.
+	page, err = s.Query(&KeyQuery{SortBy: SortBySize, Limit: 3})
+	if err != nil || page.NextCursor == "" {
+		t.Fatalf("unexpected page: %#v %v", page, err)
+	}
+	if _, err := s.Query(&KeyQuery{SortBy: SortBySize, Descending: true, Cursor: page.NextCursor}); err == nil {
+		t.Error("cursor accepted with another direction")
+	}
+	if _, err := s.Query(&KeyQuery{SortBy: SortByRefCnt, Cursor: page.NextCursor}); err == nil {
+		t.Error("cursor accepted with another sort key")
+	}
+	page, err = s.Query(&KeyQuery{SortBy: SortBySize, Limit: 3, Cursor: page.NextCursor})
+	if err != nil || len(page.Keys) != 3 || page.Keys[0].Size != 3 || page.Keys[2].Size != 5 {
+		t.Errorf("unexpected page: %#v %v", page, err)
+	}
+	// Scanning in batches gives the same page.
+	scan, err := s.newKeyScan(&KeyQuery{SortBy: SortByRefCnt, Descending: true, Limit: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps := 1
+	for !s.scanKeys(scan, 3) {
+		steps++
+	}
+	page = s.keyPage(scan)
+	if steps != 4 || len(page.Keys) != 4 || page.Keys[0].MaxRefCnt != 3 || page.Keys[3].MaxRefCnt != 2 {
+		t.Errorf("unexpected page in %d steps: %#v", steps, page.Keys)
+	}
+}
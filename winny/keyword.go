@@ -0,0 +1,47 @@
+package winny
+
+import (
+	"github.com/peryaudo/goony/winny/proto"
+	"time"
+)
+
+// KeywordEvent is a searching keyword flowing through the network with the metadata of its query.
+type KeywordEvent struct {
+	Keyword string
+	Id      uint32
+	Trip    string
+	IsBbs   bool
+
+	// Addresses (host:port) of the nodes the query has passed through, the origin first.
+	Path []string
+
+	// Address (host:port) of the peer which delivered the query.
+	Peer           string
+	FromDownstream bool
+	ReceivedAt     time.Time
+}
+
+func newKeywordEvent(recvCmd *recvCmd) *KeywordEvent {
+	query := recvCmd.cmd.(*proto.Query)
+
+	e := &KeywordEvent{
+		Keyword:        query.Keyword,
+		Id:             query.Id,
+		Trip:           tripString(query.Trip[:]),
+		IsBbs:          query.IsBbs,
+		Path:           make([]string, len(query.Nodes)),
+		Peer:           recvCmd.From.String(),
+		FromDownstream: recvCmd.FromDownstream,
+		ReceivedAt:     recvCmd.Received}
+	for i, n := range query.Nodes {
+		e.Path[i] = n.String()
+	}
+	return e
+}
+
+// clone returns a copy of the event so that each subscriber owns its own.
+func (e *KeywordEvent) clone() *KeywordEvent {
+	c := *e
+	c.Path = append([]string{}, e.Path...)
+	return &c
+}
@@ -1,61 +1,465 @@
 package winny
 
 import (
+	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
-func (k *FileKey) Match(keyword string) bool {
-	for _, word := range strings.Split(keyword, " 　") {
-		if len(word) == 0 {
+// This file implements the search query language for file keys.
+//
+// A query consists of terms separated by spaces (including full-width spaces).
+// All the terms must match, except that terms joined by | or OR form a group
+// where any one of them must match.
+//
+//	foo bar        file names containing both foo and bar
+//	"foo bar"      file names containing the phrase foo bar
+//	foo | bar      file names containing foo or bar
+//	-foo           file names not containing foo
+//	%0123...ef     the key with the hash
+//	size:>100MB    keys larger than 100MB (>, >=, <, <= and = are supported)
+//	ext:zip        file names with the extension
+//	trip:abcdefgh  keys with the trip
+//
+// File names and terms are normalized before comparison. By default, the
+// comparison ignores case, character width and the difference between
+// katakana and hiragana. See Normalization.
+//
+// Regular expressions and globs are also supported by CompileRegexpQuery and
+// CompileGlobQuery. They are matched against the whole file name as it is.
+
+// QueryMode is the type of a query.
+type QueryMode int
+
+const (
+	// The query language described above.
+	QuerySubstring QueryMode = iota
+	// Regular expressions in the syntax of the regexp package.
+	QueryRegexp
+	// Globs where * matches any sequence, ? matches any character and [...] matches a character class.
+	QueryGlob
+)
+
+// Query is a compiled search query.
+// It is immutable and can be reused across many keys concurrently.
+type Query struct {
+	Mode   QueryMode
+	Source string
+
+	// Conjunction of disjunctions of the terms for QuerySubstring.
+	groups [][]*queryTerm
+	norm   Normalization
+
+	// Compiled pattern for QueryRegexp and QueryGlob.
+	re *regexp.Regexp
+}
+
+// Compiles the query string of the mode.
+// QuerySubstring queries are compiled with DefaultNormalization.
+func CompileQueryMode(mode QueryMode, s string) (q *Query, err error) {
+	switch mode {
+	case QuerySubstring:
+		return CompileQuery(s)
+	case QueryRegexp:
+		return CompileRegexpQuery(s)
+	case QueryGlob:
+		return CompileGlobQuery(s)
+	}
+	err = errors.New(fmt.Sprintf("unknown query mode: %d", mode))
+	return
+}
+
+// Compiles the regular expression into a query matching the file names.
+func CompileRegexpQuery(expr string) (q *Query, err error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return
+	}
+	q = &Query{Mode: QueryRegexp, Source: expr, re: re}
+	return
+}
+
+// Compiles the glob into a query matching the whole file names.
+func CompileGlobQuery(pattern string) (q *Query, err error) {
+	var expr bytes.Buffer
+	expr.WriteString("^")
+
+	runes := []rune(pattern)
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		case '[':
+			end := i + 1
+			if end < len(runes) && runes[end] == '!' {
+				end++
+			}
+			if end < len(runes) && runes[end] == ']' {
+				end++
+			}
+			for end < len(runes) && runes[end] != ']' {
+				end++
+			}
+			if end == len(runes) {
+				err = errors.New("unterminated character class: " + pattern)
+				return
+			}
+
+			class := runes[i+1 : end]
+			expr.WriteString("[")
+			if len(class) > 0 && class[0] == '!' {
+				expr.WriteString("^")
+				class = class[1:]
+			}
+			for _, r := range class {
+				if r == '\\' || r == '[' || r == ']' {
+					expr.WriteRune('\\')
+				}
+				expr.WriteRune(r)
+			}
+			expr.WriteString("]")
+			i = end
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return
+	}
+	q = &Query{Mode: QueryGlob, Source: pattern, re: re}
+	return
+}
+
+// Returns the keyword to be sent to the network for the query.
+// Only substring queries have keywords because other nodes do not understand the patterns.
+// The keyword consists of the plain text terms which must match; filters, negated terms
+// and OR groups are left to the local matching because other nodes do not understand them.
+func (q *Query) Keyword() string {
+	if q.Mode != QuerySubstring {
+		return ""
+	}
+
+	words := make([]string, 0)
+	for _, group := range q.groups {
+		if len(group) != 1 {
 			continue
 		}
+		if t := group[0]; t.kind == termText && !t.negate {
+			words = append(words, t.raw)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+const (
+	termText = iota
+	termHash
+	termSize
+	termExt
+	termTrip
+)
+
+type queryTerm struct {
+	kind   int
+	negate bool
+
+	text   string // normalized text for termText and termExt, raw trip for termTrip
+	raw    string // text as written for termText
+	hash   [16]byte
+	sizeOp string
+	size   uint64
+}
+
+// Compiles the query string with DefaultNormalization.
+// The empty query matches all the keys.
+func CompileQuery(s string) (q *Query, err error) {
+	return CompileQueryNormalized(s, DefaultNormalization)
+}
 
-		if word[0] == '%' {
-			if !k.matchHash(word) {
-				return false
+// Compiles the query string with the normalization applied to both file names and terms.
+func CompileQueryNormalized(s string, n Normalization) (q *Query, err error) {
+	tokens, err := tokenizeQuery(s)
+	if err != nil {
+		return
+	}
+
+	q = &Query{Mode: QuerySubstring, Source: s, norm: n}
+	joinNext := false
+	for _, tok := range tokens {
+		if !tok.quoted && (tok.text == "|" || tok.text == "OR") {
+			if len(q.groups) == 0 || joinNext {
+				err = errors.New("OR without a preceding term: " + s)
+				return
 			}
+			joinNext = true
 			continue
 		}
 
-		if !k.matchSingle(word) {
-			return false
+		var term *queryTerm
+		term, err = compileTerm(tok, n)
+		if err != nil {
+			return
 		}
+		if term == nil {
+			continue
+		}
+
+		if joinNext {
+			last := len(q.groups) - 1
+			q.groups[last] = append(q.groups[last], term)
+			joinNext = false
+		} else {
+			q.groups = append(q.groups, []*queryTerm{term})
+		}
+	}
+	if joinNext {
+		err = errors.New("OR without a following term: " + s)
+		return
+	}
+	return
+}
+
+// Returns true if the key matches the query.
+func (q *Query) Match(k *FileKey) bool {
+	return q.match(k, "", false)
+}
+
+// matchNormalized is the same as Match, but takes the file name
+// already normalized by DefaultNormalization to avoid normalizing it for every query.
+func (q *Query) matchNormalized(k *FileKey, name string) bool {
+	return q.match(k, name, q.norm == DefaultNormalization)
+}
+
+func (q *Query) match(k *FileKey, fileName string, normalized bool) bool {
+	if q.re != nil {
+		return q.re.MatchString(k.FileName)
 	}
 
+	// Normalize the file name lazily because many queries have no text terms.
+	for _, group := range q.groups {
+		matched := false
+		for _, term := range group {
+			if (term.kind == termText || term.kind == termExt) && !normalized {
+				fileName = q.norm.Apply(k.FileName)
+				normalized = true
+			}
+			if term.match(k, fileName) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
 	return true
 }
 
-func (k *FileKey) matchSingle(word string) bool {
-	negate := false
-	if word[0] == '-' {
-		negate = true
-		word = word[1:]
+func (t *queryTerm) match(k *FileKey, fileName string) bool {
+	var matched bool
+
+	switch t.kind {
+	case termText:
+		matched = strings.Contains(fileName, t.text)
+	case termHash:
+		matched = k.Hash == t.hash
+	case termSize:
+		matched = compareSize(uint64(k.Size), t.sizeOp, t.size)
+	case termExt:
+		matched = strings.HasSuffix(fileName, "."+t.text)
+	case termTrip:
+		matched = tripString(k.Trip[:]) == t.text
 	}
 
-	contain := strings.Contains(k.FileName, word)
+	if t.negate {
+		return !matched
+	}
+	return matched
+}
+
+type queryToken struct {
+	text   string
+	quoted bool
+	negate bool
+}
+
+func isQuerySpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '　'
+}
+
+// tokenizeQuery splits the query by spaces and full-width spaces.
+// Double-quoted phrases are single tokens.
+func tokenizeQuery(s string) (tokens []queryToken, err error) {
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		if isQuerySpace(runes[i]) {
+			i++
+			continue
+		}
+
+		tok := queryToken{}
+		if runes[i] == '-' && i+1 < len(runes) && runes[i+1] == '"' {
+			tok.negate = true
+			i++
+		}
+
+		if runes[i] == '"' {
+			end := i + 1
+			for end < len(runes) && runes[end] != '"' {
+				end++
+			}
+			if end == len(runes) {
+				err = errors.New("unterminated quote: " + s)
+				return
+			}
+			tok.text = string(runes[i+1 : end])
+			tok.quoted = true
+			i = end + 1
+		} else {
+			end := i
+			for end < len(runes) && !isQuerySpace(runes[end]) {
+				end++
+			}
+			tok.text = string(runes[i:end])
+			i = end
+		}
 
-	if negate {
-		return !contain
-	} else {
-		return contain
+		tokens = append(tokens, tok)
 	}
+	return
 }
 
-func (k *FileKey) matchHash(hash string) bool {
-	b, err := hex.DecodeString(hash[1:])
-	if err != nil {
-		return false
+// compileTerm compiles the token into a term. It returns nil for empty terms.
+func compileTerm(tok queryToken, n Normalization) (t *queryTerm, err error) {
+	t = &queryTerm{negate: tok.negate}
+	text := tok.text
+
+	if tok.quoted {
+		if len(text) == 0 {
+			return nil, nil
+		}
+		t.kind = termText
+		t.text = n.Apply(text)
+		t.raw = text
+		return
+	}
+
+	if text[0] == '-' {
+		t.negate = true
+		text = text[1:]
 	}
-	if len(b) != len(k.Hash) {
-		return false
+	if len(text) == 0 {
+		return nil, nil
 	}
 
-	for i := 0; i < len(k.Hash); i++ {
-		if b[i] != k.Hash[i] {
-			return false
+	switch {
+	case text[0] == '%':
+		t.kind = termHash
+		var b []byte
+		b, err = hex.DecodeString(text[1:])
+		if err != nil || len(b) != len(t.hash) {
+			err = errors.New("invalid hash: " + text)
+			return
+		}
+		copy(t.hash[:], b)
+
+	case strings.HasPrefix(text, "size:"):
+		t.kind = termSize
+		t.sizeOp, t.size, err = parseSizeFilter(text[len("size:"):])
+
+	case strings.HasPrefix(text, "ext:"):
+		t.kind = termExt
+		t.text = n.Apply(strings.TrimPrefix(text[len("ext:"):], "."))
+		if len(t.text) == 0 {
+			err = errors.New("empty extension: " + text)
 		}
+
+	case strings.HasPrefix(text, "trip:"):
+		// Trips are case-sensitive.
+		t.kind = termTrip
+		t.text = text[len("trip:"):]
+		if len(t.text) == 0 {
+			err = errors.New("empty trip: " + text)
+		}
+
+	default:
+		t.kind = termText
+		t.text = n.Apply(text)
+		t.raw = text
 	}
+	return
+}
 
-	return true
+// parseSizeFilter parses size filters such as >100MB, <=1.5GB and =1024.
+func parseSizeFilter(s string) (op string, size uint64, err error) {
+	for _, o := range []string{">=", "<=", ">", "<", "="} {
+		if strings.HasPrefix(s, o) {
+			op = o
+			s = s[len(o):]
+			break
+		}
+	}
+	if len(op) == 0 {
+		op = "="
+	}
+
+	upper := strings.ToUpper(s)
+	unit := uint64(1)
+	for _, u := range []struct {
+		suffix string
+		unit   uint64
+	}{
+		{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(upper, u.suffix) {
+			unit = u.unit
+			upper = upper[:len(upper)-len(u.suffix)]
+			break
+		}
+	}
+
+	// Sizes that do not fit in uint64, including infinities and NaN, are invalid
+	// because their conversion is implementation dependent.
+	num, err := strconv.ParseFloat(upper, 64)
+	if err != nil || math.IsNaN(num) || num < 0 || num >= math.MaxUint64/float64(unit) {
+		err = errors.New(fmt.Sprintf("invalid size filter: %s", s))
+		return
+	}
+	size = uint64(num * float64(unit))
+	return
+}
+
+func compareSize(size uint64, op string, operand uint64) bool {
+	switch op {
+	case ">":
+		return size > operand
+	case ">=":
+		return size >= operand
+	case "<":
+		return size < operand
+	case "<=":
+		return size <= operand
+	default:
+		return size == operand
+	}
+}
+
+// tripString converts the NUL-terminated trip into a string.
+func tripString(trip []byte) string {
+	for i, b := range trip {
+		if b == 0 {
+			return string(trip[:i])
+		}
+	}
+	return string(trip)
 }
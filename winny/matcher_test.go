@@ -0,0 +1,165 @@
+package winny
+
+import (
+	"testing"
+)
+
+func TestQueryMatch(t *testing.T) {
+	k := &FileKey{
+		Size:     150 * 1024 * 1024,
+		Hash:     [16]byte{0xea, 0xd4, 0x1d, 0x47, 0xfa, 0xc8, 0x09, 0xb9, 0xaf, 0xd6, 0x2e, 0xfb, 0x05, 0x15, 0x7b, 0x2f},
+		FileName: "[Goony] Albatross Vol.01 (Ｔｅｓｔ).zip",
+		Trip:     [11]byte{'m', '7', 'G', 'g', 'Y', 'j', 'h', 'I', 'i', 'U'}}
+
+	matches := []string{
+		"",
+		"albatross",
+		"goony　vol.01",
+		"test",
+		"TEST",
+		`"albatross vol"`,
+		"-jpg",
+		`-"vol.02"`,
+		"foo | albatross",
+		"foo OR bar OR zip",
+		"size:>100MB",
+		"size:<=1g",
+		"ext:zip",
+		"ext:.ZIP",
+		"trip:m7GgYjhIiU",
+		"%ead41d47fac809b9afd62efb05157b2f"}
+	mismatches := []string{
+		"gooney",
+		"goony -albatross",
+		`"vol albatross"`,
+		"foo | bar",
+		"size:<100MB",
+		"ext:rar",
+		"trip:m7ggyjhiiu",
+		"%00d41d47fac809b9afd62efb05157b2f"}
+	invalids := []string{
+		`"unterminated`,
+		"| foo",
+		"foo OR",
+		"size:>abc",
+		"size:>inf",
+		"size:<-Inf",
+		"size:NaN",
+		"size:>1e400",
+		"size:>18446744073709551616",
+		"size:>17179869184GB",
+		"%zz"}
+
+	for _, s := range matches {
+		q, err := CompileQuery(s)
+		if err != nil {
+			t.Errorf("query %#v: %v", s, err)
+			continue
+		}
+		if !q.Match(k) {
+			t.Errorf("query %#v should match", s)
+		}
+	}
+	for _, s := range mismatches {
+		q, err := CompileQuery(s)
+		if err != nil {
+			t.Errorf("query %#v: %v", s, err)
+			continue
+		}
+		if q.Match(k) {
+			t.Errorf("query %#v should not match", s)
+		}
+	}
+	for _, s := range invalids {
+		if _, err := CompileQuery(s); err == nil {
+			t.Errorf("query %#v should be invalid", s)
+		}
+	}
+}
+
+func TestNormalization(t *testing.T) {
+	k := &FileKey{FileName: "ｶﾀｶﾅ ﾃｽﾄ ＡＢＣ ㈱ごーにー"}
+
+	cases := []struct {
+		query string
+		norm  Normalization
+		match bool
+	}{
+		{"かたかな", NormalizeAll, true},
+		{"カタカナ てすと abc", NormalizeAll, true},
+		{"(株)ゴーニー", NormalizeAll, true},
+		{"カタカナ", NormalizeNFKC, true},
+		{"かたかな", NormalizeNFKC, false},
+		{"かたかな", NormalizeWidth | NormalizeKana, true},
+		{"abc", NormalizeWidth, false},
+		{"abc", NormalizeWidth | NormalizeCase, true},
+		{"ｶﾀｶﾅ", NormalizeNone, true},
+		{"カタカナ", NormalizeNone, false}}
+	for _, c := range cases {
+		q, err := CompileQueryNormalized(c.query, c.norm)
+		if err != nil {
+			t.Errorf("query %#v: %v", c.query, err)
+			continue
+		}
+		if q.Match(k) != c.match {
+			t.Errorf("query %#v normalization %d: expected %v", c.query, c.norm, c.match)
+		}
+	}
+}
+
+func TestPatternQuery(t *testing.T) {
+	k := &FileKey{FileName: "[Goony] Albatross Vol.01.zip"}
+
+	cases := []struct {
+		mode    QueryMode
+		pattern string
+		match   bool
+	}{
+		{QueryRegexp, `\[.*\] .*\.(zip|rar)$`, true},
+		{QueryRegexp, `^Albatross`, false},
+		{QueryRegexp, `(?i)albatross`, true},
+		{QueryGlob, `[[]Goony] *.zip`, true},
+		{QueryGlob, `*Vol.0?.zip`, true},
+		{QueryGlob, `*Vol.0[!1].zip`, false},
+		{QueryGlob, `*.rar`, false},
+		{QueryGlob, `Albatross*`, false}}
+	for _, c := range cases {
+		q, err := CompileQueryMode(c.mode, c.pattern)
+		if err != nil {
+			t.Errorf("pattern %#v: %v", c.pattern, err)
+			continue
+		}
+		if q.Match(k) != c.match {
+			t.Errorf("pattern %#v: expected %v", c.pattern, c.match)
+		}
+		if q.Keyword() != "" {
+			t.Errorf("pattern %#v: keyword should be empty", c.pattern)
+		}
+	}
+
+	if _, err := CompileGlobQuery("[abc"); err == nil {
+		t.Error("unterminated character class accepted")
+	}
+}
+
+func TestQueryKeyword(t *testing.T) {
+	cases := []struct {
+		query   string
+		keyword string
+	}{
+		{"foo bar", "foo bar"},
+		{`size:>1M ext:zip foo OR "bar baz"`, ""},
+		{`size:>1M ext:zip foo "bar baz"`, "foo bar baz"},
+		{"-foo %00112233445566778899aabbccddeeff trip:abc Ｆｏｏ", "Ｆｏｏ"},
+		{"", ""}}
+	for _, c := range cases {
+		q, err := CompileQuery(c.query)
+		if err != nil {
+			t.Errorf("query %#v: %v", c.query, err)
+			continue
+		}
+		if q.Keyword() != c.keyword {
+			t.Errorf("query %#v: expected keyword %#v, actual %#v", c.query, c.keyword, q.Keyword())
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"crypto/rc4"
 	"errors"
 	"fmt"
+	"github.com/peryaudo/goony/winny/proto"
+	"io"
 	"log"
 	"net"
 	"strconv"
@@ -16,20 +18,56 @@ type nodeConn struct {
 
 	nodeAddr nodeAddr
 
-	conn *rc4Conn
+	conn   *rc4Conn
+	framer *proto.Framer
 
 	IsNat        bool
 	IsDownstream bool
-	cmdConnType
+	proto.ConnType
+
+	// Negotiated by the ProtoHdr of the peer.
+	PeerType PeerType
+	Features Feature
 
 	Since time.Time
+
+	// Outbound commands written by the writer goroutine.
+	sendQueue chan cmd
+	// Consecutive commands dropped because sendQueue was full.
+	sendDropped int
+	// The last command written before closing the connection by CloseWith.
+	closeNotice chan cmd
+	// Closed when the connection is closed.
+	done chan struct{}
 }
 
-func nodeConnAccept(conn net.Conn, m *nodeMgr) {
-	c := &nodeConn{
+const (
+	// Length of the outbound command queue of each connection.
+	sendQueueLen = 64
+
+	// The connection is closed as a slow peer after
+	// maxDroppedSends commands are dropped in a row.
+	maxDroppedSends = 32
+
+	// CloseWith closes the connection after the timeout even if the notice is not written.
+	closeNoticeTimeout = 10 * time.Second
+)
+
+func newNodeConn(conn net.Conn, nodeAddr nodeAddr, isDownstream bool, m *nodeMgr) *nodeConn {
+	rc := &rc4Conn{Raw: m.throttle(conn)}
+	return &nodeConn{
 		mgr:          m,
-		conn:         &rc4Conn{Raw: conn},
-		IsDownstream: true}
+		nodeAddr:     nodeAddr,
+		conn:         rc,
+		framer:       proto.NewFramer(rc, rc),
+		IsDownstream: isDownstream,
+		sendQueue:    make(chan cmd, sendQueueLen),
+		closeNotice:  make(chan cmd, 1),
+		done:         make(chan struct{})}
+}
+
+func nodeConnAccept(conn net.Conn, m *nodeMgr) {
+	c := newNodeConn(conn, nodeAddr{}, true, m)
 	copy(c.nodeAddr.IP[:], c.remoteIP())
 	c.establish()
 }
@@ -49,51 +87,88 @@ func nodeConnDial(nodeAddr nodeAddr, m *nodeMgr) {
 		return
 	}
 
-	c := &nodeConn{
-		mgr:          m,
-		nodeAddr:     nodeAddr,
-		conn:         &rc4Conn{Raw: conn},
-		IsDownstream: false}
+	c := newNodeConn(conn, nodeAddr, false, m)
 	c.establish()
 }
 
+// Send queues the command to be sent by the writer goroutine without blocking.
+// It must be called only from the node manager goroutine.
+// If the queue is full, the command is dropped, and the connection is closed
+// when the peer is too slow to receive commands.
 func (c *nodeConn) Send(cmd cmd) (err error) {
-	// Special case
-	if cmdQuery, ok := cmd.(*cmdQuery); ok {
-		log.Println("send cmdQuery to ", net.IP(c.nodeAddr.IP[:]))
-
-		// Add own IP to the node list
-		localAddr := nodeAddr{Port: c.mgr.servent.Port}
-		copy(localAddr.IP[:], c.localIP())
-		cmdQuery.Nodes = append(cmdQuery.Nodes, localAddr)
+	select {
+	case c.sendQueue <- cmd:
+		c.sendDropped = 0
+		return
+	default:
 	}
 
-	payload, err := cmd.Marshal()
-	if err != nil {
+	c.sendDropped++
+	if c.sendDropped >= maxDroppedSends {
+		c.Close()
+		err = errors.New("send queue overflow; closed slow peer")
 		return
 	}
+	err = errors.New("send queue full; command dropped")
+	return
+}
 
-	length := uint32(len(payload) + 1)
-	idx := byte(cmd.Idx())
-
-	err = writeLE(c.conn, length)
-	if err != nil {
-		return
+// writeLoop sends the queued commands until the connection is closed.
+func (c *nodeConn) writeLoop() {
+	for {
+		select {
+		case cmd := <-c.sendQueue:
+			if err := c.send(cmd); err != nil {
+				c.Close()
+				return
+			}
+		case cmd := <-c.closeNotice:
+			c.send(cmd)
+			c.Close()
+			return
+		case <-c.done:
+			return
+		}
 	}
-	err = writeLE(c.conn, idx)
-	if err != nil {
-		return
+}
+
+// send writes the command to the connection synchronously.
+func (c *nodeConn) send(cmd cmd) (err error) {
+	// Special case
+	if query, ok := cmd.(*proto.Query); ok {
+		log.Println("send Query to ", net.IP(c.nodeAddr.IP[:]))
+
+		// Add own IP to the node list.
+		// The command is copied because it may be shared with other connections.
+		localAddr := nodeAddr{Port: c.mgr.servent.Port}
+		copy(localAddr.IP[:], c.localIP())
+		copied := *query
+		copied.Nodes = append(append([]nodeAddr{}, query.Nodes...), localAddr)
+		cmd = &copied
 	}
-	err = writeLE(c.conn, payload)
-	return
+
+	return c.framer.WriteCommand(cmd)
 }
 
 func (c *nodeConn) Close() error {
 	return c.conn.Raw.Close()
 }
 
+// CloseWith closes the connection after the writer goroutine sent the command to the peer.
+// It must be called only from the node manager goroutine, and it never blocks.
+// The connection is closed after closeNoticeTimeout anyway in case the peer is not receiving.
+func (c *nodeConn) CloseWith(cmd cmd) {
+	select {
+	case c.closeNotice <- cmd:
+	default:
+		// Already closing
+	}
+	time.AfterFunc(closeNoticeTimeout, func() { c.Close() })
+}
+
 func (c *nodeConn) establish() {
 	defer c.Close()
+	defer close(c.done)
 	var err error
 
 	err = c.sendHandshake()
@@ -127,19 +202,48 @@ func (c *nodeConn) establish() {
 		c.IsDownstream = remoteSpeed < localSpeed
 	}
 
+	go c.writeLoop()
+
 	c.mgr.established <- e
 
+	c.recvLoop()
+}
+
+// recvLoop passes the received commands to the dispatcher until the connection fails
+// or the peer floods it.
+func (c *nodeConn) recvLoop() {
+	limiter := newTokenBucket(cmdRate, cmdBurst)
+	dropped := &dropCounter{Window: dropWindow, Max: maxDroppedCmds}
+
 	for {
 		cmd, err := c.recv()
 		if err != nil {
+			_, malformed := err.(*malformedCmdError)
 			c.mgr.closed <- &closedConn{
 				Addr:   c.nodeAddr,
-				Reason: errors.New(fmt.Sprintf("recv failed: %v", err))}
+				Reason: errors.New(fmt.Sprintf("recv failed: %v", err)),
+				Ban:    malformed}
 			return
 		}
+
+		// Drop the commands exceeding the rate limit, and give up the peer if it keeps flooding.
+		if !isControlCmd(cmd) && !limiter.Allow() {
+			if dropped.Add(time.Now()) {
+				c.mgr.closed <- &closedConn{
+					Addr:   c.nodeAddr,
+					Reason: errors.New("command flooding"),
+					Ban:    true}
+				return
+			}
+			continue
+		}
+
+		// Sending to recvCmd blocks only this connection when the dispatcher is busy,
+		// which also stops reading from the flooding peer.
 		c.mgr.servent.recvCmd <- &recvCmd{
 			FromDownstream: c.IsDownstream,
 			From:           c.nodeAddr,
+			Received:       time.Now(),
 			cmd:            cmd}
 	}
 }
@@ -148,42 +252,40 @@ func (c *nodeConn) sendHandshake() (err error) {
 	var rnd [6]byte
 	rand.Read(rnd[:])
 
-	err = writeLE(c.conn, rnd[:])
+	_, err = c.conn.Write(rnd[:])
 	if err != nil {
 		return err
 	}
 
 	// Ignore the top two bytes of the generated random bytes as RC4 key
 	key := rnd[2:]
-	c.conn.WCip, _ = rc4.NewCipher(strlenWorkaround(key))
+	c.conn.WCip = proto.NewStreamCipher(key)
 
-	err = c.Send(&cmdCompat{})
+	err = c.send(&proto.Compat{})
 	if err != nil {
 		return
 	}
 
-	err = c.Send(&cmdProtoHdr{
-		Ver:     12710,
-		CertStr: "Winny Ver2.0b1 (goony)"})
+	profile := c.mgr.servent.profile()
+	err = c.send(&proto.ProtoHdr{
+		Ver:     profile.Ver,
+		CertStr: profile.CertStr})
 	if err != nil {
 		return
 	}
 
-	// Shuffle the key
-	for i := 1; i < 4; i++ {
-		key[i] ^= 0x39
-	}
-	c.conn.WCip, _ = rc4.NewCipher(strlenWorkaround(key))
+	proto.ShuffleKey(key)
+	c.conn.WCip = proto.NewStreamCipher(key)
 
-	err = c.Send(c.mgr.cmdSpeed())
+	err = c.send(c.mgr.cmdSpeed())
 	if err != nil {
 		return
 	}
-	err = c.Send(c.mgr.cmdConnType())
+	err = c.send(c.mgr.cmdConnType())
 	if err != nil {
 		return
 	}
-	err = c.Send(c.mgr.cmdSelfAddr(c.localIP()))
+	err = c.send(c.mgr.cmdSelfAddr(c.localIP()))
 	return
 }
 
@@ -191,13 +293,13 @@ func (c *nodeConn) recvHandshake() (e *establishedConn, err error) {
 	e = &establishedConn{nodeConn: c, PrevAddr: c.nodeAddr}
 
 	var rnd [6]byte
-	err = readLE(c.conn, rnd[:])
+	_, err = io.ReadFull(c.conn, rnd[:])
 	if err != nil {
 		return
 	}
 
 	key := rnd[2:]
-	c.conn.RCip, _ = rc4.NewCipher(strlenWorkaround(key))
+	c.conn.RCip = proto.NewStreamCipher(key)
 
 	var cmd cmd
 
@@ -205,9 +307,9 @@ func (c *nodeConn) recvHandshake() (e *establishedConn, err error) {
 	if err != nil {
 		return
 	}
-	_, ok := cmd.(*cmdCompat)
+	_, ok := cmd.(*proto.Compat)
 	if !ok {
-		err = errors.New("receiving cmdCompat failed")
+		err = errors.New("receiving Compat failed")
 		return
 	}
 
@@ -215,25 +317,26 @@ func (c *nodeConn) recvHandshake() (e *establishedConn, err error) {
 	if err != nil {
 		return
 	}
-	e.ProtoHdr, ok = cmd.(*cmdProtoHdr)
+	e.ProtoHdr, ok = cmd.(*proto.ProtoHdr)
 	if !ok {
-		err = errors.New("receiving cmdProtoHdr failed")
+		err = errors.New("receiving ProtoHdr failed")
 		return
 	}
-
-	// Shuffle the key
-	for i := 1; i < 4; i++ {
-		key[i] ^= 0x39
+	c.PeerType, c.Features, err = c.mgr.servent.profile().negotiate(e.ProtoHdr)
+	if err != nil {
+		return
 	}
-	c.conn.RCip, _ = rc4.NewCipher(strlenWorkaround(key))
+
+	proto.ShuffleKey(key)
+	c.conn.RCip = proto.NewStreamCipher(key)
 
 	cmd, err = c.recv()
 	if err != nil {
 		return
 	}
-	e.Speed, ok = cmd.(*cmdSpeed)
+	e.Speed, ok = cmd.(*proto.Speed)
 	if !ok {
-		err = errors.New("receiving cmdSpeed failed")
+		err = errors.New("receiving Speed failed")
 		return
 	}
 
@@ -241,20 +344,20 @@ func (c *nodeConn) recvHandshake() (e *establishedConn, err error) {
 	if err != nil {
 		return
 	}
-	e.ConnType, ok = cmd.(*cmdConnType)
+	e.ConnType, ok = cmd.(*proto.ConnType)
 	if !ok {
-		err = errors.New("receiving cmdConnType failed")
+		err = errors.New("receiving ConnType failed")
 		return
 	}
-	c.cmdConnType = *e.ConnType
+	c.ConnType = *e.ConnType
 
 	cmd, err = c.recv()
 	if err != nil {
 		return
 	}
-	e.SelfAddr, ok = cmd.(*cmdSelfAddr)
+	e.SelfAddr, ok = cmd.(*proto.SelfAddr)
 	if !ok {
-		err = errors.New("receiving cmdSelfAddr failed")
+		err = errors.New("receiving SelfAddr failed")
 		return
 	}
 
@@ -268,109 +371,40 @@ func (c *nodeConn) recvHandshake() (e *establishedConn, err error) {
 // TODO(peryaudo): instead of directly forwarding cmdQuery, replace private IP with node's global IP.
 // TODO(peryaudo): set deadline to all the recvs
 func (c *nodeConn) recv() (cmd cmd, err error) {
-	var length uint32
-	var idx byte
-
-	err = readLE(c.conn, &length)
-	if err != nil {
-		return
-	}
-	err = readLE(c.conn, &idx)
-	if err != nil {
-		return
-	}
-
-	switch idx {
-	case cmdIdxProtoHdr:
-		cmd = &cmdProtoHdr{}
-	case cmdIdxSpeed:
-		cmd = &cmdSpeed{}
-	case cmdIdxConnType:
-		cmd = &cmdConnType{}
-	case cmdIdxSelfAddr:
-		cmd = &cmdSelfAddr{}
-	case cmdIdxAddr:
-		cmd = &cmdAddr{}
-	case cmdIdxSpread:
-		cmd = &cmdSpread{}
-	case cmdIdxCacheReq:
-		cmd = &cmdCacheReq{}
-	case cmdIdxSpreadCond:
-		cmd = &cmdSpreadCond{}
-	case cmdIdxQuery:
-		cmd = &cmdQuery{}
-	case cmdIdxCacheRes:
-		cmd = &cmdCacheRes{}
-
-	case cmdIdxClose:
-		cmd = &cmdClose{}
-	case cmdIdxCloseTransLimit:
-		cmd = &cmdCloseTransLimit{}
-	case cmdIdxCloseBadPort0:
-		cmd = &cmdCloseBadPort0{}
-	case cmdIdxCloseIgnored:
-		cmd = &cmdCloseIgnored{}
-	case cmdIdxCloseSlow:
-		cmd = &cmdCloseSlow{}
-	case cmdIdxCloseForgery:
-		cmd = &cmdCloseForgery{}
-
-	case cmdIdxCompat:
-		cmd = &cmdCompat{}
-
-	default:
-		err = errors.New("Invalid command index")
-		return
-	}
-
-	if cmd.Idx() != int(idx) {
-		panic("command index mismatching!")
-	}
-
-	if idx == cmdIdxCacheRes && length > 70*1024*1024 {
-		err = errors.New("payload too long")
-	}
-	if idx != cmdIdxCacheRes && length > 1*1024*1024 {
-		err = errors.New("payload too long")
-	}
-	if err != nil {
-		return
-	}
-
-	payload := make([]byte, length-1)
-	err = readLE(c.conn, payload)
+	idx, payload, err := c.framer.ReadFrame()
 	if err != nil {
+		if _, ok := err.(*proto.FrameError); ok {
+			err = &malformedCmdError{err.Error(), err}
+		}
 		return
 	}
 
-	err = cmd.Unmarshal(payload)
-
+	cmd, err = proto.Parse(idx, payload)
 	if err != nil {
-		if cmd.Idx() == cmdIdxQuery {
-			err = errors.New(fmt.Sprintf("command parsing error: %v type: %T", err, cmd))
+		if idx == proto.IdxQuery {
+			err = &malformedCmdError{fmt.Sprintf("command parsing error: %v type: %T", err, cmd), err}
 		} else {
-			err = errors.New(fmt.Sprintf("command parsing error: %v type: %T payload: %#v", err, cmd, payload))
+			err = &malformedCmdError{fmt.Sprintf("command parsing error: %v type: %T payload: %#v", err, cmd, payload), err}
 		}
 	}
 
-	// log.Printf("%#v\n", cmd)
+	return
+}
 
-	// FIXME: DBG
-	if err == nil && cmd.Idx() != cmdIdxQuery {
-		marshaled, err := cmd.Marshal()
-		if err != nil || len(marshaled) != len(payload) {
-			log.Printf("failed recv payload: %#v", payload)
-			panic(fmt.Sprintf("remarshaling failed %#v", cmd))
-		}
-		for i := 0; i < len(marshaled); i++ {
-			if marshaled[i] != payload[i] {
-				panic(fmt.Sprintf("remarshaling failed %#v", cmd))
-			}
-		}
-	}
-	// FIXME: DBG END
+// malformedCmdError indicates that the peer sent a command that cannot be parsed.
+// Peers sending malformed commands are banned for a while.
+// err is the *proto.FrameError or *proto.DecodeError describing the cause.
+type malformedCmdError struct {
+	msg string
+	err error
+}
 
-	return
+func (e *malformedCmdError) Error() string {
+	return e.msg
+}
+
+func (e *malformedCmdError) Unwrap() error {
+	return e.err
 }
 
 func (c *nodeConn) localIP() []byte {
@@ -385,25 +419,18 @@ func (c *nodeConn) remoteIP() []byte {
 	return net.ParseIP(host).To4()
 }
 
-// Imitating Winny's infamous usage of strlen
-func strlenWorkaround(b []byte) []byte {
-	if b[0] == 0 {
-		return b[0:1]
-	}
-	for i := 1; i < len(b); i++ {
-		if b[i] == 0 {
-			return b[0:i]
-		}
-	}
-	return b
-}
-
 type rc4Conn struct {
 	RCip *rc4.Cipher
 	WCip *rc4.Cipher
 	Raw  net.Conn
+
+	// Reused for encryption; writes are serialized by writeLoop.
+	wbuf []byte
 }
 
+// Encryption buffers larger than this are not kept after the write.
+const maxRc4BufLen = 128 * 1024
+
 func (c *rc4Conn) Read(b []byte) (n int, err error) {
 	n, err = c.Raw.Read(b)
 	if c.RCip != nil {
@@ -413,10 +440,20 @@ func (c *rc4Conn) Read(b []byte) (n int, err error) {
 }
 
 func (c *rc4Conn) Write(b []byte) (n int, err error) {
-	enc := make([]byte, len(b))
+	if cap(c.wbuf) < len(b) {
+		c.wbuf = make([]byte, len(b))
+	}
+	enc := c.wbuf[:len(b)]
 	if c.WCip != nil {
 		c.WCip.XORKeyStream(enc, b)
+	} else {
+		// The random bytes of the handshake are sent in plaintext
+		// because the peer derives the RC4 key from them.
+		copy(enc, b)
 	}
 	n, err = c.Raw.Write(enc)
+	if cap(c.wbuf) > maxRc4BufLen {
+		c.wbuf = nil
+	}
 	return
 }
@@ -0,0 +1,70 @@
+package winny
+
+import (
+	"bytes"
+	"errors"
+	"github.com/peryaudo/goony/winny/proto"
+	"io"
+	"net"
+	"testing"
+)
+
+// FuzzRecv checks that no input from the peers panics the servent.
+func FuzzRecv(f *testing.F) {
+	var buf bytes.Buffer
+	for _, c := range []cmd{&proto.Speed{Speed: 100}, &proto.Query{Keyword: "foo"}, &proto.Close{}} {
+		if err := proto.Encode(&buf, c); err != nil {
+			f.Fatal(err)
+		}
+	}
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c := &nodeConn{framer: proto.NewFramer(bytes.NewReader(b), nil)}
+		for {
+			_, err := c.recv()
+			if err == nil {
+				continue
+			}
+			var malformed *malformedCmdError
+			if err != io.EOF && err != io.ErrUnexpectedEOF && !errors.As(err, &malformed) {
+				t.Errorf("unexpected error: %v", err)
+			}
+			return
+		}
+	})
+}
+
+func TestSendClosesSlowPeer(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	go io.Copy(io.Discard, remote)
+	c := newNodeConn(local, nodeAddr{}, false, newNodeMgr(&Servent{}))
+
+	// The writer is not running, so the queue is never drained.
+	for i := 0; i < sendQueueLen; i++ {
+		if err := c.Send(&proto.Spread{}); err != nil {
+			t.Fatalf("command %d: %v", i, err)
+		}
+	}
+	for i := 1; i < maxDroppedSends; i++ {
+		if err := c.Send(&proto.Spread{}); err == nil {
+			t.Fatalf("drop %d: command queued beyond the queue", i)
+		}
+	}
+	if _, err := local.Write([]byte{0}); err == io.ErrClosedPipe {
+		t.Fatal("closed before maxDroppedSends drops")
+	}
+
+	// A successful send resets the count.
+	<-c.sendQueue
+	if err := c.Send(&proto.Spread{}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < maxDroppedSends; i++ {
+		c.Send(&proto.Spread{})
+	}
+	if _, err := local.Write([]byte{0}); err != io.ErrClosedPipe {
+		t.Errorf("slow peer is not closed: %v", err)
+	}
+}
@@ -2,12 +2,14 @@ package winny
 
 import (
 	"errors"
+	"github.com/peryaudo/goony/winny/proto"
 	"log"
 	"math"
 	"math/rand"
 	"net"
 	"runtime"
 	"strconv"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,26 +20,42 @@ type nodeMgr struct {
 	servent *Servent
 
 	// Send a command to a random node with the matching condition.
+	// Use Send rather than sending to the channel directly so that the senders never block.
+	// The manager never blocks on the network either; each connection has its own send queue.
 	SendCmd chan *sendCmd
 
+	// Number of commands dropped by Send because SendCmd was full.
+	droppedCmds atomic.Uint64
+
 	// Add nodes to the list.
-	AddNode     chan *cmdAddr
+	AddNode     chan *proto.Addr
 	AddNodeAddr chan nodeAddr
 	AddNodeStr  chan string
 
 	// Disconnect from the node.
 	Disconnect chan nodeAddr
 
+	// Disconnect from the node and refuse it temporarily.
+	Ban chan *banReq
+
 	// Returns complete node list in the encrypted form.
 	GetNodeList chan chan []string
 
 	getConnNodeCnt chan chan int
+	getCensus      chan chan *Census
 
 	established chan *establishedConn
 	closed      chan *closedConn
+	resolved    chan *resolvedHost
 
 	connNodes map[nodeAddr]*nodeConn
 	nodes     map[nodeAddr]*nodeInfo
+	ddnsNodes map[string]*ddnsNode
+	bans      *banList
+
+	// Global bandwidth limiters shared by all the connections.
+	upLimiter   *RateLimiter
+	downLimiter *RateLimiter
 
 	addConnTrying chan struct{}
 	subConnTrying chan struct{}
@@ -50,21 +68,30 @@ type establishedConn struct {
 	Addr     nodeAddr
 	PrevAddr nodeAddr
 
-	ProtoHdr *cmdProtoHdr
-	Speed    *cmdSpeed
-	ConnType *cmdConnType
-	SelfAddr *cmdSelfAddr
+	ProtoHdr *proto.ProtoHdr
+	Speed    *proto.Speed
+	ConnType *proto.ConnType
+	SelfAddr *proto.SelfAddr
 }
 
 type closedConn struct {
 	Addr nodeAddr
 
 	Reason error
+	Ban    bool // true if the node misbehaved and should be banned
+}
+
+type banReq struct {
+	Addr nodeAddr
+
+	// Sent to the node before disconnecting it if not nil, e.g. cmdCloseForgery.
+	Notice cmd
 }
 
 type recvCmd struct {
 	From           nodeAddr
 	FromDownstream bool
+	Received       time.Time
 
 	cmd
 }
@@ -72,29 +99,53 @@ type recvCmd struct {
 type sendCmd struct {
 	To        *nodeAddr // nil if the target is not specific
 	Direction int       // Ignored if To is not nil
+	Except    *nodeAddr // Never sent to the node, typically the sender of a relayed command
+	Count     int       // Number of nodes for directionRandomN; sent to none if not positive
+
+	// Receives the delivery result if not nil.
+	Result chan *sendResult
 
 	cmd
 }
 
 const (
-	directionAll = iota
-	directionRoughlyUp
+	directionAll       = iota // a random node
+	directionRoughlyUp        // a random upstream node, or a random downstream node if there's no upstream
+	directionAllUp            // all the upstream nodes
+	directionAllDown          // all the downstream nodes
+	directionBroadcast        // all the nodes
+	directionRandomN          // Count random nodes
 )
 
+// sendResult reports which nodes the command is delivered to.
+// Delivered means the command is queued to the connection.
+type sendResult struct {
+	Sent    []nodeAddr
+	Dropped []nodeAddr // the send queue was full
+}
+
+// Length of the buffer of the commands waiting for the node manager.
+const sendCmdBufLen = 64
+
 func newNodeMgr(s *Servent) *nodeMgr {
 	return &nodeMgr{
 		servent:        s,
-		SendCmd:        make(chan *sendCmd),
-		AddNode:        make(chan *cmdAddr),
+		SendCmd:        make(chan *sendCmd, sendCmdBufLen),
+		AddNode:        make(chan *proto.Addr),
 		AddNodeAddr:    make(chan nodeAddr),
 		AddNodeStr:     make(chan string),
 		Disconnect:     make(chan nodeAddr),
+		Ban:            make(chan *banReq),
 		GetNodeList:    make(chan chan []string),
 		getConnNodeCnt: make(chan chan int),
+		getCensus:      make(chan chan *Census),
 		established:    make(chan *establishedConn),
 		closed:         make(chan *closedConn),
+		resolved:       make(chan *resolvedHost),
 		connNodes:      make(map[nodeAddr]*nodeConn),
 		nodes:          make(map[nodeAddr]*nodeInfo),
+		ddnsNodes:      make(map[string]*ddnsNode),
+		bans:           newBanList(),
 
 		// Simultaneous connection trial limit
 		addConnTrying: make(chan struct{}),
@@ -116,12 +167,29 @@ func (m *nodeMgr) listen() {
 			log.Println(err)
 			return
 		}
+
+		var ip [4]byte
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			copy(ip[:], addr.IP.To4())
+		}
+		if m.isRefused(ip) {
+			conn.Close()
+			continue
+		}
+
 		go nodeConnAccept(conn, m)
 	}
 
 }
 
 func (m *nodeMgr) ListenAndServe() {
+	uploadLimit := m.servent.UploadLimit
+	if uploadLimit == 0 {
+		uploadLimit = speedToBytesPerSec(m.servent.Speed)
+	}
+	m.upLimiter = NewRateLimiter(uploadLimit)
+	m.downLimiter = NewRateLimiter(m.servent.DownloadLimit)
+
 	go m.listen()
 
 	manageTick := time.Tick(4 * time.Second)
@@ -141,7 +209,7 @@ func (m *nodeMgr) ListenAndServe() {
 			m.addNode(cmdaddr)
 
 		case nodeaddr := <-m.AddNodeAddr:
-			if !isPrivateIP(nodeaddr.IP[:]) && m.nodes[nodeaddr] == nil {
+			if !isPrivateIP(nodeaddr.IP[:]) && !m.isRefused(nodeaddr.IP) && m.nodes[nodeaddr] == nil {
 				m.nodes[nodeaddr] = &nodeInfo{}
 			}
 
@@ -153,12 +221,20 @@ func (m *nodeMgr) ListenAndServe() {
 				m.connNodes[nodeaddr].Close()
 			}
 
+		case req := <-m.Ban:
+			m.ban(req.Addr, req.Notice)
+
 		case listChan := <-m.GetNodeList:
 			nodeStrs := make([]string, len(m.nodes))
 			i := 0
-			for addr, _ := range m.nodes {
-				nodeStr, _ := EncryptNodeString(
-					net.IP(addr.IP[:]).String() + ":" + strconv.Itoa(addr.Port))
+			for addr, info := range m.nodes {
+				// Prefer DDNS host names because they survive IP address changes.
+				// Only the tracked names are written so that the nodes cannot inject theirs.
+				host := net.IP(addr.IP[:]).String()
+				if info != nil && len(info.Ddns) > 0 && m.ddnsNodes[ddnsKey(info.Ddns, addr.Port)] != nil {
+					host = info.Ddns
+				}
+				nodeStr, _ := EncryptNodeString(host + ":" + strconv.Itoa(addr.Port))
 				nodeStrs[i] = nodeStr
 				i++
 			}
@@ -167,12 +243,21 @@ func (m *nodeMgr) ListenAndServe() {
 		case ch := <-m.getConnNodeCnt:
 			ch <- len(m.connNodes)
 
+		case ch := <-m.getCensus:
+			ch <- m.census()
+
 		case est := <-m.established:
 			m.addEstablishedNode(est)
 
+		case r := <-m.resolved:
+			m.updateResolved(r)
+
 		case cls := <-m.closed:
 			// log.Println(net.IP(cls.Addr.IP[:]), " ", cls.Reason)
 			delete(m.connNodes, cls.Addr)
+			if cls.Ban {
+				m.ban(cls.Addr, nil)
+			}
 
 		case <-m.addConnTrying:
 			m.connTrying++
@@ -183,21 +268,60 @@ func (m *nodeMgr) ListenAndServe() {
 	}
 }
 
+// Send queues the command for the node manager without blocking.
+// If SendCmd is full because the manager is busy, the command is dropped and false is returned.
+func (m *nodeMgr) Send(sendcmd *sendCmd) bool {
+	select {
+	case m.SendCmd <- sendcmd:
+		return true
+	default:
+		m.droppedCmds.Add(1)
+		return false
+	}
+}
+
 func (m *nodeMgr) selectAndSend(sendcmd *sendCmd) {
+	result := &sendResult{}
+
+	for _, conn := range m.selectTargets(sendcmd) {
+		if err := conn.Send(sendcmd.cmd); err != nil {
+			result.Dropped = append(result.Dropped, conn.nodeAddr)
+		} else {
+			result.Sent = append(result.Sent, conn.nodeAddr)
+		}
+	}
+
+	if sendcmd.Result != nil {
+		// The result channel must be buffered so that the loop never blocks.
+		select {
+		case sendcmd.Result <- result:
+		default:
+			log.Println("warning: send result channel is not ready")
+		}
+	}
+}
+
+// selectTargets returns the connections the command should be sent to.
+func (m *nodeMgr) selectTargets(sendcmd *sendCmd) []*nodeConn {
 	if sendcmd.To != nil {
 		conn := m.connNodes[*(sendcmd.To)]
-		if conn == nil {
-			return
+		if conn == nil || !conn.supports(sendcmd.cmd) {
+			return nil
 		}
-		conn.Send(sendcmd.cmd)
-
-		return
+		return []*nodeConn{conn}
 	}
 
 	all := make([]*nodeConn, 0)
 	up := make([]*nodeConn, 0)
 	down := make([]*nodeConn, 0)
-	for _, conn := range m.connNodes {
+	for addr, conn := range m.connNodes {
+		if sendcmd.Except != nil && addr == *(sendcmd.Except) {
+			continue
+		}
+		// Peers lacking the features are skipped as if they were not connected.
+		if !conn.supports(sendcmd.cmd) {
+			continue
+		}
 		all = append(all, conn)
 		if conn.IsDownstream {
 			down = append(down, conn)
@@ -209,22 +333,49 @@ func (m *nodeMgr) selectAndSend(sendcmd *sendCmd) {
 	switch sendcmd.Direction {
 	case directionAll:
 		if len(all) > 0 {
-			all[rand.Intn(len(all))].Send(sendcmd.cmd)
+			return []*nodeConn{all[rand.Intn(len(all))]}
 		}
 
 	case directionRoughlyUp:
 		if len(up) > 0 {
-			up[rand.Intn(len(up))].Send(sendcmd.cmd)
+			return []*nodeConn{up[rand.Intn(len(up))]}
 		} else if len(down) > 0 {
-			down[rand.Intn(len(down))].Send(sendcmd.cmd)
+			return []*nodeConn{down[rand.Intn(len(down))]}
 		}
+
+	case directionAllUp:
+		return up
+
+	case directionAllDown:
+		return down
+
+	case directionBroadcast:
+		return all
+
+	case directionRandomN:
+		if sendcmd.Count <= 0 {
+			return nil
+		}
+		rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+		if sendcmd.Count < len(all) {
+			return all[:sendcmd.Count]
+		}
+		return all
 	}
+
+	return nil
 }
 
-func (m *nodeMgr) addNode(c *cmdAddr) {
+func (m *nodeMgr) addNode(c *proto.Addr) {
 	key := nodeAddr{IP: c.IP, Port: c.Port}
+	if m.isRefused(key.IP) {
+		return
+	}
 
 	if m.nodes[key] == nil {
+		if len(m.nodes) >= maxKnownNodes {
+			return
+		}
 		m.nodes[key] = &nodeInfo{}
 	}
 	m.nodes[key].BbsPort = c.BbsPort
@@ -246,19 +397,25 @@ func (m *nodeMgr) addNodeStr(nodestr string) {
 		return
 	}
 
-	ip := net.ParseIP(host).To4()
-	if len(ip) != 4 {
-		log.Println("invalid IP address (DDNS not supported): " + host)
+	portInt, err := strconv.Atoi(port)
+	if err != nil {
+		log.Println(err)
 		return
 	}
 
-	if isPrivateIP(ip) {
+	if net.ParseIP(host) == nil {
+		// The host is a DDNS host name. It will be added after the resolution.
+		m.addDdnsNode(host, portInt)
 		return
 	}
 
-	portInt, err := strconv.Atoi(port)
-	if err != nil {
-		log.Println(err)
+	ip := net.ParseIP(host).To4()
+	if len(ip) != 4 {
+		log.Println("invalid IP address: " + host)
+		return
+	}
+
+	if isPrivateIP(ip) {
 		return
 	}
 
@@ -266,6 +423,10 @@ func (m *nodeMgr) addNodeStr(nodestr string) {
 	copy(key.IP[:], ip)
 	key.Port = portInt
 
+	if m.isRefused(key.IP) {
+		return
+	}
+
 	m.nodes[key] = &nodeInfo{}
 }
 
@@ -284,26 +445,31 @@ func (m *nodeMgr) addEstablishedNode(est *establishedConn) {
 	m.nodes[est.Addr].Ver = est.ProtoHdr.Ver
 	m.nodes[est.Addr].CertStr = est.ProtoHdr.CertStr
 	m.nodes[est.Addr].Speed = est.Speed.Speed
-	m.nodes[est.Addr].Ddns = est.SelfAddr.Ddns
 	m.nodes[est.Addr].Clusters = est.SelfAddr.Clusters
+	m.nodes[est.Addr].IsNat = est.IsNat
+
+	if len(est.SelfAddr.Ddns) > 0 {
+		m.nodes[est.Addr].Ddns = est.SelfAddr.Ddns
+		m.setDdnsAddr(est.SelfAddr.Ddns, est.Addr)
+	}
 
 	// log.Printf("established connection: %#v\n", m.nodes[est.Addr])
 }
 
-func (m *nodeMgr) cmdSpeed() *cmdSpeed {
-	return &cmdSpeed{Speed: m.servent.Speed}
+func (m *nodeMgr) cmdSpeed() *proto.Speed {
+	return &proto.Speed{Speed: m.servent.Speed}
 }
 
-func (m *nodeMgr) cmdConnType() *cmdConnType {
-	return &cmdConnType{
-		Type:       connTypeSearch,
+func (m *nodeMgr) cmdConnType() *proto.ConnType {
+	return &proto.ConnType{
+		Type:       proto.ConnTypeSearch,
 		IsPort0:    false,
 		IsBadPort0: false,
 		IsBbs:      false}
 }
 
-func (m *nodeMgr) cmdSelfAddr(IP []byte) (c *cmdSelfAddr) {
-	c = &cmdSelfAddr{
+func (m *nodeMgr) cmdSelfAddr(IP []byte) (c *proto.SelfAddr) {
+	c = &proto.SelfAddr{
 		Port: m.servent.Port,
 		Ddns: m.servent.Ddns}
 	copy(c.IP[:], IP)
@@ -315,7 +481,7 @@ func (m *nodeMgr) manageNodeConn() {
 	upstream := 0
 	downstream := 0
 	for _, conn := range m.connNodes {
-		if conn.Type != connTypeSearch {
+		if conn.Type != proto.ConnTypeSearch {
 			continue
 		}
 		if conn.IsDownstream {
@@ -366,7 +532,7 @@ func (m *nodeMgr) disconnShortest(isDownstream bool) {
 	var dur time.Duration = math.MaxInt64
 	var cand *nodeConn
 	for _, conn := range m.connNodes {
-		if conn.Type != connTypeSearch {
+		if conn.Type != proto.ConnTypeSearch {
 			continue
 		}
 		if conn.IsDownstream == isDownstream {
@@ -390,6 +556,11 @@ func (m *nodeMgr) selectNewNode() (k nodeAddr, err error) {
 			continue
 		}
 
+		if m.isRefused(key.IP) {
+			delete(m.nodes, key)
+			continue
+		}
+
 		if info.Speed != 0 {
 			localSpeed := float32(m.servent.Speed)
 			remoteSpeed := float32(info.Speed)
@@ -411,7 +582,28 @@ func (m *nodeMgr) selectNewNode() (k nodeAddr, err error) {
 
 func (m *nodeMgr) manageNodeList() {
 	// TODO(peryaudo): limit the number of entries in Nodes to 600 and remove far nodes
-	return
+	m.refreshDdnsNodes()
+}
+
+// isRefused returns true if the IP address is blocklisted or temporarily banned.
+func (m *nodeMgr) isRefused(ip [4]byte) bool {
+	return m.servent.Blocklist.Contains(net.IP(ip[:])) || m.bans.IsBanned(ip)
+}
+
+// ban disconnects the node and refuses its IP address for a while.
+// If notice is not nil, it is sent to the node before disconnecting.
+func (m *nodeMgr) ban(addr nodeAddr, notice cmd) {
+	log.Printf("banned %s\n", net.IP(addr.IP[:]))
+
+	m.bans.Ban(addr.IP, peerBanDuration)
+	if conn := m.connNodes[addr]; conn != nil {
+		if notice != nil {
+			conn.CloseWith(notice)
+		} else {
+			conn.Close()
+		}
+	}
+	delete(m.nodes, addr)
 }
 
 func isPrivateIP(ip []byte) bool {
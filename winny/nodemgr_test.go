@@ -0,0 +1,80 @@
+package winny
+
+import (
+	"github.com/peryaudo/goony/winny/proto"
+	"testing"
+)
+
+func TestSelectTargets(t *testing.T) {
+	m := newNodeMgr(&Servent{})
+
+	addrs := []nodeAddr{
+		{IP: [4]byte{1, 1, 1, 1}, Port: 1},
+		{IP: [4]byte{2, 2, 2, 2}, Port: 2},
+		{IP: [4]byte{3, 3, 3, 3}, Port: 3},
+		{IP: [4]byte{4, 4, 4, 4}, Port: 4},
+		{IP: [4]byte{5, 5, 5, 5}, Port: 5}}
+	for i, addr := range addrs {
+		m.connNodes[addr] = &nodeConn{
+			nodeAddr:     addr,
+			IsDownstream: i >= 2,
+			sendQueue:    make(chan cmd, 1)}
+	}
+
+	except := addrs[0]
+	cases := []struct {
+		sendcmd  sendCmd
+		expected int
+	}{
+		{sendCmd{Direction: directionAll}, 1},
+		{sendCmd{Direction: directionRoughlyUp}, 1},
+		{sendCmd{Direction: directionAllUp}, 2},
+		{sendCmd{Direction: directionAllDown}, 3},
+		{sendCmd{Direction: directionBroadcast}, 5},
+		{sendCmd{Direction: directionBroadcast, Except: &except}, 4},
+		{sendCmd{Direction: directionRandomN, Count: 3}, 3},
+		{sendCmd{Direction: directionRandomN, Count: 10}, 5},
+		{sendCmd{Direction: directionRandomN, Count: 0}, 0},
+		{sendCmd{Direction: directionRandomN, Count: -1}, 0},
+		{sendCmd{To: &addrs[4]}, 1}}
+	for i, c := range cases {
+		targets := m.selectTargets(&c.sendcmd)
+		if len(targets) != c.expected {
+			t.Errorf("case %d: expected %d targets, actual %d", i, c.expected, len(targets))
+		}
+		for _, conn := range targets {
+			if c.sendcmd.Except != nil && conn.nodeAddr == *c.sendcmd.Except {
+				t.Errorf("case %d: sent to the excepted node", i)
+			}
+		}
+	}
+
+	// The second command overflows the send queue of length 1.
+	result := make(chan *sendResult, 2)
+	for i := 0; i < 2; i++ {
+		m.selectAndSend(&sendCmd{Direction: directionAllUp, Result: result, cmd: &proto.Spread{}})
+	}
+	if r := <-result; len(r.Sent) != 2 || len(r.Dropped) != 0 {
+		t.Errorf("unexpected first result: %#v", r)
+	}
+	if r := <-result; len(r.Sent) != 0 || len(r.Dropped) != 2 {
+		t.Errorf("unexpected second result: %#v", r)
+	}
+}
+
+func TestSendNonBlocking(t *testing.T) {
+	m := newNodeMgr(&Servent{})
+
+	// Nothing receives from SendCmd, so the commands beyond the buffer are dropped.
+	for i := 0; i < sendCmdBufLen; i++ {
+		if !m.Send(&sendCmd{cmd: &proto.Spread{}}) {
+			t.Fatalf("command %d dropped before the buffer is full", i)
+		}
+	}
+	if m.Send(&sendCmd{cmd: &proto.Spread{}}) {
+		t.Error("command queued beyond the buffer")
+	}
+	if m.droppedCmds.Load() != 1 {
+		t.Errorf("expected 1 dropped command, actual %d", m.droppedCmds.Load())
+	}
+}
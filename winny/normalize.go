@@ -0,0 +1,61 @@
+package winny
+
+import (
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/text/width"
+	"strings"
+	"unicode"
+)
+
+// Normalization specifies how file names and query terms are normalized before matching.
+// Flags can be combined.
+type Normalization int
+
+const (
+	// Applies Unicode NFKC normalization, e.g. ㈱ to (株) and ｶﾞ to ガ.
+	NormalizeNFKC Normalization = 1 << iota
+	// Folds full-width alphanumerics into half-width ones and half-width katakana into full-width ones.
+	NormalizeWidth
+	// Folds katakana into hiragana.
+	NormalizeKana
+	// Folds upper cases into lower cases.
+	NormalizeCase
+
+	NormalizeNone Normalization = 0
+	NormalizeAll                = NormalizeNFKC | NormalizeWidth | NormalizeKana | NormalizeCase
+
+	// Normalization used by CompileQuery.
+	DefaultNormalization = NormalizeAll
+)
+
+// Returns the normalized string.
+func (n Normalization) Apply(s string) string {
+	if n&NormalizeNFKC != 0 {
+		s = norm.NFKC.String(s)
+	}
+	if n&NormalizeWidth != 0 {
+		s = width.Fold.String(s)
+	}
+	if n&(NormalizeKana|NormalizeCase) != 0 {
+		s = strings.Map(func(r rune) rune {
+			if n&NormalizeKana != 0 {
+				r = foldKana(r)
+			}
+			if n&NormalizeCase != 0 {
+				r = unicode.ToLower(r)
+			}
+			return r
+		}, s)
+	}
+	return s
+}
+
+// foldKana converts a katakana into the corresponding hiragana.
+// Katakana without hiragana counterparts such as ヷ are left as they are.
+func foldKana(r rune) rune {
+	// ァ (U+30A1) to ヶ (U+30F6) correspond to ぁ (U+3041) to ゖ (U+3096).
+	if r >= 'ァ' && r <= 'ヶ' {
+		return r - 0x60
+	}
+	return r
+}
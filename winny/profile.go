@@ -0,0 +1,144 @@
+package winny
+
+import (
+	"errors"
+	"fmt"
+	"github.com/peryaudo/goony/winny/proto"
+	"strings"
+)
+
+// Feature is a set of protocol features a client supports.
+type Feature uint
+
+const (
+	// Relays search queries and spreads file keys.
+	FeatureSearch Feature = 1 << iota
+	// Relays BBS queries.
+	FeatureBbs
+	// Serves file blocks by CacheReq and CacheRes.
+	FeatureTransfer
+)
+
+// ClientProfile describes the client advertised in the handshake and the peers it talks to.
+type ClientProfile struct {
+	// Sent in ProtoHdr.
+	Ver     int
+	CertStr string
+
+	// Features of the local client, which are used with all the peers by default.
+	Features Feature
+
+	// Narrows the features used with each peer to the ones its PeerType is assumed to support.
+	NarrowFeatures bool
+
+	// Peers with the versions out of the range are refused. Zero means unbounded.
+	MinPeerVer int
+	MaxPeerVer int
+
+	// Refuses the peers whose cert strings are not known as Winny or its clones.
+	RefuseUnknown bool
+}
+
+// DefaultProfile returns a new copy of the profile used if Servent.Profile is nil.
+// It accepts all the peers and uses the same features with them.
+func DefaultProfile() *ClientProfile {
+	return &ClientProfile{
+		Ver:      12710,
+		CertStr:  winnyCertStr + " (goony)",
+		Features: FeatureSearch | FeatureBbs}
+}
+
+// PeerType is the kind of the client software of a peer, guessed from its ProtoHdr.
+type PeerType int
+
+const (
+	PeerUnknown PeerType = iota
+	// The original Winny 2, which sends the cert string as is.
+	PeerWinny
+	// Clones such as goony, which append their names to the cert string of Winny 2.
+	PeerClone
+)
+
+// Cert string of Winny 2, which is shared by all the releases of it.
+const winnyCertStr = "Winny Ver2.0b1"
+
+func (t PeerType) String() string {
+	switch t {
+	case PeerWinny:
+		return "Winny"
+	case PeerClone:
+		return "clone"
+	}
+	return "unknown"
+}
+
+// Features the client software of the type is assumed to support.
+// Clones are not trusted with transfers because most of them only search.
+// It is used only if ClientProfile.NarrowFeatures is set.
+func (t PeerType) Features() Feature {
+	switch t {
+	case PeerWinny:
+		return FeatureSearch | FeatureBbs | FeatureTransfer
+	case PeerClone:
+		return FeatureSearch | FeatureBbs
+	}
+	return FeatureSearch
+}
+
+// Guesses the client software of the peer from its cert string.
+func ClassifyPeer(certStr string) PeerType {
+	if certStr == winnyCertStr {
+		return PeerWinny
+	}
+	if strings.HasPrefix(certStr, winnyCertStr+" ") {
+		return PeerClone
+	}
+	return PeerUnknown
+}
+
+// negotiate checks the ProtoHdr of the peer and returns the features used with it.
+func (p *ClientProfile) negotiate(hdr *proto.ProtoHdr) (t PeerType, features Feature, err error) {
+	if p.MinPeerVer != 0 && hdr.Ver < p.MinPeerVer || p.MaxPeerVer != 0 && hdr.Ver > p.MaxPeerVer {
+		err = errors.New(fmt.Sprintf("incompatible version %d (%q)", hdr.Ver, hdr.CertStr))
+		return
+	}
+
+	t = ClassifyPeer(hdr.CertStr)
+	if t == PeerUnknown && p.RefuseUnknown {
+		err = errors.New(fmt.Sprintf("unknown client %q", hdr.CertStr))
+		return
+	}
+
+	features = p.Features
+	if p.NarrowFeatures {
+		features &= t.Features()
+	}
+	return
+}
+
+// requiredFeatures returns the features a peer must support to receive the command.
+func requiredFeatures(c cmd) Feature {
+	switch c := c.(type) {
+	case *proto.Query:
+		if c.IsBbs {
+			return FeatureBbs
+		}
+		return FeatureSearch
+	case *proto.CacheReq, *proto.CacheRes:
+		return FeatureTransfer
+	}
+	return 0
+}
+
+// supports reports whether the command can be sent to the peer.
+func (c *nodeConn) supports(cmd cmd) bool {
+	required := requiredFeatures(cmd)
+	return c.Features&required == required
+}
+
+func (s *Servent) profile() *ClientProfile {
+	if s.Profile == nil {
+		return DefaultProfile()
+	}
+	return s.Profile
+}
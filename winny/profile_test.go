@@ -0,0 +1,71 @@
+package winny
+
+import (
+	"github.com/peryaudo/goony/winny/proto"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	strict := DefaultProfile()
+	strict.MinPeerVer = 12710
+	strict.MaxPeerVer = 12710
+	strict.RefuseUnknown = true
+
+	narrow := DefaultProfile()
+	narrow.NarrowFeatures = true
+
+	cases := []struct {
+		profile  *ClientProfile
+		hdr      proto.ProtoHdr
+		peerType PeerType
+		features Feature
+		refused  bool
+	}{
+		{DefaultProfile(), proto.ProtoHdr{Ver: 12710, CertStr: "Winny Ver2.0b1"}, PeerWinny, FeatureSearch | FeatureBbs, false},
+		{DefaultProfile(), proto.ProtoHdr{Ver: 12710, CertStr: "Winny Ver2.0b1 (goony)"}, PeerClone, FeatureSearch | FeatureBbs, false},
+		{DefaultProfile(), proto.ProtoHdr{Ver: 12710, CertStr: "Other"}, PeerUnknown, FeatureSearch | FeatureBbs, false},
+		{DefaultProfile(), proto.ProtoHdr{Ver: 11000, CertStr: "Winny Ver1.14"}, PeerUnknown, FeatureSearch | FeatureBbs, false},
+		{narrow, proto.ProtoHdr{Ver: 12710, CertStr: "Winny Ver2.0b1"}, PeerWinny, FeatureSearch | FeatureBbs, false},
+		{narrow, proto.ProtoHdr{Ver: 12710, CertStr: "Other"}, PeerUnknown, FeatureSearch, false},
+		{strict, proto.ProtoHdr{Ver: 11000, CertStr: "Winny Ver2.0b1"}, PeerUnknown, 0, true},
+		{strict, proto.ProtoHdr{Ver: 13000, CertStr: "Winny Ver2.0b1"}, PeerUnknown, 0, true},
+		{strict, proto.ProtoHdr{Ver: 12710, CertStr: "Other"}, PeerUnknown, 0, true}}
+	for i, c := range cases {
+		peerType, features, err := c.profile.negotiate(&c.hdr)
+		if (err != nil) != c.refused {
+			t.Errorf("case %d: expected refused %v, actual error %v", i, c.refused, err)
+			continue
+		}
+		if !c.refused && (peerType != c.peerType || features != c.features) {
+			t.Errorf("case %d: expected %v %b, actual %v %b", i, c.peerType, c.features, peerType, features)
+		}
+	}
+}
+
+func TestSelectTargetsFeatures(t *testing.T) {
+	m := newNodeMgr(&Servent{})
+
+	search := nodeAddr{IP: [4]byte{1, 1, 1, 1}, Port: 1}
+	bbs := nodeAddr{IP: [4]byte{2, 2, 2, 2}, Port: 2}
+	m.connNodes[search] = &nodeConn{nodeAddr: search, Features: FeatureSearch}
+	m.connNodes[bbs] = &nodeConn{nodeAddr: bbs, Features: FeatureSearch | FeatureBbs}
+
+	cases := []struct {
+		cmd      cmd
+		expected int
+	}{
+		{&proto.Query{}, 2},
+		{&proto.Query{IsBbs: true}, 1},
+		{&proto.CacheReq{}, 0},
+		{&proto.Spread{}, 2}}
+	for i, c := range cases {
+		targets := m.selectTargets(&sendCmd{Direction: directionBroadcast, cmd: c.cmd})
+		if len(targets) != c.expected {
+			t.Errorf("case %d: expected %d targets, actual %d", i, c.expected, len(targets))
+		}
+	}
+
+	if targets := m.selectTargets(&sendCmd{To: &search, cmd: &proto.Query{IsBbs: true}}); len(targets) != 0 {
+		t.Errorf("BBS query sent to the peer without FeatureBbs")
+	}
+}
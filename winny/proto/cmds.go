@@ -0,0 +1,791 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// This file implements marshaling and unmarshaling of Winny commands.
+
+// Command indexes
+const (
+	IdxProtoHdr   = 0
+	IdxSpeed      = 1
+	IdxConnType   = 2
+	IdxSelfAddr   = 3
+	IdxAddr       = 4
+	IdxSpread     = 10
+	IdxCacheReq   = 11
+	IdxSpreadCond = 12
+	IdxQuery      = 13
+	IdxCacheRes   = 21
+
+	IdxClose           = 31
+	IdxCloseTransLimit = 32
+	IdxCloseBadPort0   = 33
+	IdxCloseIgnored    = 34
+	IdxCloseSlow       = 35
+	IdxCloseForgery    = 37
+
+	IdxCompat = 97
+)
+
+func (c *ProtoHdr) Idx() int   { return IdxProtoHdr }
+func (c *Speed) Idx() int      { return IdxSpeed }
+func (c *ConnType) Idx() int   { return IdxConnType }
+func (c *SelfAddr) Idx() int   { return IdxSelfAddr }
+func (c *Addr) Idx() int       { return IdxAddr }
+func (c *Spread) Idx() int     { return IdxSpread }
+func (c *CacheReq) Idx() int   { return IdxCacheReq }
+func (c *SpreadCond) Idx() int { return IdxSpreadCond }
+func (c *Query) Idx() int      { return IdxQuery }
+func (c *CacheRes) Idx() int   { return IdxCacheRes }
+
+func (c *Close) Idx() int           { return IdxClose }
+func (c *CloseTransLimit) Idx() int { return IdxCloseTransLimit }
+func (c *CloseBadPort0) Idx() int   { return IdxCloseBadPort0 }
+func (c *CloseIgnored) Idx() int    { return IdxCloseIgnored }
+func (c *CloseSlow) Idx() int       { return IdxCloseSlow }
+func (c *CloseForgery) Idx() int    { return IdxCloseForgery }
+
+func (c *Compat) Idx() int { return IdxCompat }
+
+// Spread requests the spreading of the keys.
+type Spread struct{ noPayload }
+
+// Close and the following commands tell the reason of the disconnection.
+type Close struct{ noPayload }
+type CloseTransLimit struct{ noPayload }
+type CloseBadPort0 struct{ noPayload }
+type CloseIgnored struct{ noPayload }
+type CloseSlow struct{ noPayload }
+type CloseForgery struct{ noPayload }
+
+// Compat is sent at the beginning of the handshake for the compatibility with older versions.
+type Compat struct{ noPayload }
+
+type noPayload struct {
+}
+
+func (c *noPayload) Marshal() (b []byte, err error) {
+	b = []byte{}
+	return
+}
+
+func (c *noPayload) AppendPayload(b []byte) ([]byte, error) {
+	return b, nil
+}
+
+func (c *noPayload) Unmarshal(b []byte) (err error) {
+	if len(b) > 0 {
+		err = fmt.Errorf("%w: %d bytes", ErrTrailing, len(b))
+	}
+	return
+}
+
+// ProtoHdr tells the protocol version and the certification string of the client.
+type ProtoHdr struct {
+	Ver     int
+	CertStr string
+}
+
+var protoHdrCertKey = []byte{0x39, 0x38, 0x37, 0x38, 0x39, 0x61, 0x73, 0x6a}
+
+func (c *ProtoHdr) Marshal() (b []byte, err error) {
+	var bs bytes.Buffer
+	w := &leWriter{w: &bs}
+	w.write(uint32(c.Ver))
+	w.write([]byte(c.CertStr))
+	b, err = bs.Bytes(), w.err
+	if err != nil {
+		return
+	}
+
+	cip, _ := rc4.NewCipher(protoHdrCertKey)
+	cip.XORKeyStream(b, b)
+	return
+}
+
+func (c *ProtoHdr) Unmarshal(b []byte) (err error) {
+	dec := make([]byte, len(b))
+	cip, _ := rc4.NewCipher(protoHdrCertKey)
+	cip.XORKeyStream(dec, b)
+
+	bs := bytes.NewBuffer(dec)
+	var ver uint32
+	err = readField(bs, &ver)
+	if err != nil {
+		return
+	}
+	c.Ver = int(ver)
+
+	// The rest of the payload is the cert string.
+	c.CertStr = bs.String()
+	return
+}
+
+// Speed tells the line speed in kbps.
+type Speed struct {
+	Speed int
+}
+
+func (c *Speed) Marshal() (b []byte, err error) {
+	var bs bytes.Buffer
+	w := &leWriter{w: &bs}
+	w.write(float32(c.Speed))
+	b, err = bs.Bytes(), w.err
+	return
+}
+
+func (c *Speed) Unmarshal(b []byte) (err error) {
+	bs := bytes.NewBuffer(b)
+	var speed float32
+	err = readField(bs, &speed)
+	if err != nil {
+		return
+	}
+	c.Speed = int(speed)
+	return checkTrailing(bs)
+}
+
+// ConnType tells the purpose of the connection.
+type ConnType struct {
+	Type       int
+	IsPort0    bool
+	IsBadPort0 bool
+	IsBbs      bool
+}
+
+// Purposes of the connections
+const (
+	ConnTypeSearch   = 0
+	ConnTypeTransfer = 1
+	ConnTypeBbs      = 2
+)
+
+func (c *ConnType) Marshal() (b []byte, err error) {
+	var bs bytes.Buffer
+	w := &leWriter{w: &bs}
+	w.write(byte(c.Type))
+	w.write(toByte(c.IsPort0))
+	w.write(toByte(c.IsBadPort0))
+	w.write(toByte(c.IsBbs))
+	b, err = bs.Bytes(), w.err
+	return
+}
+
+func (c *ConnType) Unmarshal(b []byte) (err error) {
+	var linkType, port0, badPort0, bbs byte
+
+	bs := bytes.NewBuffer(b)
+	err = readField(bs, &linkType)
+	if err != nil {
+		return
+	}
+	err = readField(bs, &port0)
+	if err != nil {
+		return
+	}
+	err = readField(bs, &badPort0)
+	if err != nil {
+		return
+	}
+	err = readField(bs, &bbs)
+	if err != nil {
+		return
+	}
+
+	c.Type = int(linkType)
+	c.IsPort0 = port0 != 0
+	c.IsBadPort0 = badPort0 != 0
+	c.IsBbs = bbs != 0
+	err = checkTrailing(bs)
+	return
+}
+
+// SelfAddr tells the address of the sender itself.
+type SelfAddr struct {
+	IP       [4]byte
+	Port     int
+	Ddns     string
+	Clusters [3]string
+}
+
+func (c *SelfAddr) Marshal() (b []byte, err error) {
+	var bs bytes.Buffer
+	w := &leWriter{w: &bs}
+	w.write(c.IP)
+	w.write(uint32(c.Port))
+
+	// Convert DDNS and cluster strings to Shift-JIS
+	ddns, err := toSjis(c.Ddns)
+	if err != nil {
+		return
+	}
+
+	var clusters [3][]byte
+	for i := 0; i < 3; i++ {
+		clusters[i], err = toSjis(c.Clusters[i])
+		if err != nil {
+			return
+		}
+	}
+
+	err = checkLen("DDNS", len(ddns), math.MaxUint8)
+	if err != nil {
+		return
+	}
+	for i := 0; i < 3; i++ {
+		err = checkLen("cluster", len(clusters[i]), math.MaxUint8)
+		if err != nil {
+			return
+		}
+	}
+
+	// Write their lengths
+	w.write(byte(len(ddns)))
+	for i := 0; i < 3; i++ {
+		w.write(byte(len(clusters[i])))
+	}
+
+	// Write their bytes
+	w.write(ddns)
+	for i := 0; i < 3; i++ {
+		w.write(clusters[i])
+	}
+
+	b, err = bs.Bytes(), w.err
+	return
+}
+
+func (c *SelfAddr) Unmarshal(b []byte) (err error) {
+	bs := bytes.NewBuffer(b)
+
+	err = readField(bs, c.IP[:])
+	if err != nil {
+		return
+	}
+
+	var port uint32
+	err = readField(bs, &port)
+	if err != nil {
+		return
+	}
+	c.Port = int(port)
+
+	// Read lengths of DDNS and cluster strings
+
+	var ddnsLen byte
+	err = readField(bs, &ddnsLen)
+	if err != nil {
+		return
+	}
+
+	var clusterLens [3]byte
+	for i := 0; i < 3; i++ {
+		err = readField(bs, &clusterLens[i])
+		if err != nil {
+			return
+		}
+	}
+
+	// Allocate byte arrays with the lengths
+
+	ddns := make([]byte, ddnsLen)
+	var clusters [3][]byte
+	for i := 0; i < 3; i++ {
+		clusters[i] = make([]byte, clusterLens[i])
+	}
+
+	// Read the strings
+
+	err = readField(bs, ddns)
+	if err != nil {
+		return
+	}
+	for i := 0; i < 3; i++ {
+		err = readField(bs, clusters[i])
+		if err != nil {
+			return
+		}
+	}
+
+	// Convert them into UTF-8
+
+	c.Ddns, err = toUtf8(ddns)
+	if err != nil {
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		c.Clusters[i], err = toUtf8(clusters[i])
+		if err != nil {
+			return
+		}
+	}
+
+	err = checkTrailing(bs)
+	return
+}
+
+// Addr tells the address of another node.
+type Addr struct {
+	IP       [4]byte
+	Port     int
+	BbsPort  int
+	IsBbs    bool
+	Speed    int
+	Clusters [3]string
+}
+
+func (c *Addr) Marshal() (b []byte, err error) {
+	var bs bytes.Buffer
+	w := &leWriter{w: &bs}
+	w.write(c.IP)
+	w.write(uint32(c.Port))
+	w.write(uint32(c.BbsPort))
+	w.write(toByte(c.IsBbs))
+	w.write(uint32(c.Speed))
+
+	// Convert cluster strings to Shift-JIS
+	var clusters [3][]byte
+	for i := 0; i < 3; i++ {
+		clusters[i], err = toSjis(c.Clusters[i])
+		if err != nil {
+			return
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		err = checkLen("cluster", len(clusters[i]), math.MaxUint8)
+		if err != nil {
+			return
+		}
+	}
+
+	// Write their lengths
+	for i := 0; i < 3; i++ {
+		w.write(byte(len(clusters[i])))
+	}
+
+	// Write their bytes
+	for i := 0; i < 3; i++ {
+		w.write(clusters[i])
+	}
+
+	b, err = bs.Bytes(), w.err
+	return
+}
+
+func (c *Addr) Unmarshal(b []byte) (err error) {
+	bs := bytes.NewBuffer(b)
+
+	var port, bbsPort, speed uint32
+
+	err = readField(bs, c.IP[:])
+	if err != nil {
+		return
+	}
+	err = readField(bs, &port)
+	if err != nil {
+		return
+	}
+	c.Port = int(port)
+	err = readField(bs, &bbsPort)
+	if err != nil {
+		return
+	}
+	c.BbsPort = int(bbsPort)
+	var bbs byte
+	err = readField(bs, &bbs)
+	if err != nil {
+		return
+	}
+	c.IsBbs = bbs != 0
+	err = readField(bs, &speed)
+	if err != nil {
+		return
+	}
+	c.Speed = int(speed)
+
+	var clusterLens [3]byte
+	for i := 0; i < 3; i++ {
+		err = readField(bs, &clusterLens[i])
+		if err != nil {
+			return
+		}
+	}
+
+	var clusters [3][]byte
+	for i := 0; i < 3; i++ {
+		clusters[i] = make([]byte, clusterLens[i])
+	}
+	for i := 0; i < 3; i++ {
+		err = readField(bs, clusters[i])
+		if err != nil {
+			return
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		c.Clusters[i], err = toUtf8(clusters[i])
+		if err != nil {
+			return
+		}
+	}
+	err = checkTrailing(bs)
+	return
+}
+
+// CacheReq requests the blocks of the file with the hash.
+type CacheReq struct {
+	Id       uint32
+	BeginIdx uint32
+	Num      uint32
+	Hash     [16]byte
+	Size     uint32
+}
+
+func (c *CacheReq) Marshal() (b []byte, err error) {
+	var bs bytes.Buffer
+	w := &leWriter{w: &bs}
+	w.write(c.Id)
+	w.write(c.BeginIdx)
+	w.write(c.Num)
+	w.write(c.Hash[:])
+	w.write(c.Size)
+	b, err = bs.Bytes(), w.err
+	return
+}
+
+func (c *CacheReq) Unmarshal(b []byte) (err error) {
+	bs := bytes.NewBuffer(b)
+	err = readField(bs, &c.Id)
+	if err != nil {
+		return
+	}
+	err = readField(bs, &c.BeginIdx)
+	if err != nil {
+		return
+	}
+	err = readField(bs, &c.Num)
+	if err != nil {
+		return
+	}
+	err = readField(bs, c.Hash[:])
+	if err != nil {
+		return
+	}
+	err = readField(bs, &c.Size)
+	if err != nil {
+		return
+	}
+	return checkTrailing(bs)
+}
+
+// ??? It seems both pyny and poeny are not taking things seriously for the implementations of SpreadCond
+type SpreadCond struct {
+	// Keyword string
+	Keyword [256]byte
+	Trip    [16]byte
+	Id      uint32
+}
+
+func (c *SpreadCond) Marshal() (b []byte, err error) {
+	var bs bytes.Buffer
+	w := &leWriter{w: &bs}
+	/*
+		keyword, err := toSjis(c.Keyword)
+		var expanded [256]byte
+		copy(expanded[:], keyword)
+
+		w.write(expanded)
+	*/
+	w.write(c.Keyword)
+	w.write(c.Trip)
+	w.write(c.Id)
+	b, err = bs.Bytes(), w.err
+	return
+}
+
+func (c *SpreadCond) Unmarshal(b []byte) (err error) {
+	bs := bytes.NewBuffer(b)
+
+	/*
+		var keyword [256]byte
+		err = readField(bs, keyword[:])
+		if err != nil {
+			return
+		}
+
+		keywordLen := 0
+		for i := 0; i < len(keyword); i++ {
+			if keyword[i] == 0 {
+				break
+			}
+			keywordLen++
+		}
+		c.Keyword, err = toUtf8(keyword[0:keywordLen])
+	*/
+	err = readField(bs, c.Keyword[:])
+	if err != nil {
+		return
+	}
+
+	err = readField(bs, c.Trip[:])
+	if err != nil {
+		return
+	}
+	err = readField(bs, &c.Id)
+	if err != nil {
+		return
+	}
+	return checkTrailing(bs)
+}
+
+// Query carries a search query or its reply with the matching keys.
+type Query struct {
+	IsReply      bool
+	IsSpread     bool
+	IsDownstream bool
+	IsBbs        bool
+	Id           uint32
+	Keyword      string
+	Trip         [11]byte
+	Nodes        []NodeAddr
+	Keys         []FileKey
+}
+
+func (c *Query) Marshal() (b []byte, err error) {
+	return c.AppendPayload(nil)
+}
+
+func (c *Query) AppendPayload(b []byte) (_ []byte, err error) {
+	bs := bytes.NewBuffer(b)
+	w := &leWriter{w: bs}
+	w.write(toByte(c.IsReply))
+	w.write(toByte(c.IsSpread))
+	w.write(toByte(c.IsDownstream))
+	w.write(toByte(c.IsBbs))
+	w.write(c.Id)
+
+	keyword, err := toSjis(c.Keyword)
+	if err != nil {
+		return
+	}
+	err = checkLen("keyword", len(keyword), math.MaxUint8)
+	if err != nil {
+		return
+	}
+	err = checkLen("nodes", len(c.Nodes), math.MaxUint8)
+	if err != nil {
+		return
+	}
+	err = checkLen("keys", len(c.Keys), MaxQueryKeys)
+	if err != nil {
+		return
+	}
+
+	w.write(byte(len(keyword)))
+	w.write(keyword)
+	w.write(c.Trip[:])
+
+	w.write(byte(len(c.Nodes)))
+	for _, n := range c.Nodes {
+		err = n.MarshalStream(bs)
+		if err != nil {
+			return
+		}
+	}
+
+	w.write(uint16(len(c.Keys)))
+	for _, k := range c.Keys {
+		err = k.MarshalStream(bs)
+		if err != nil {
+			return
+		}
+	}
+
+	return bs.Bytes(), w.err
+}
+
+func (c *Query) Unmarshal(b []byte) (err error) {
+	var reply, spread, downstream, bbs byte
+
+	bs := bytes.NewBuffer(b)
+	err = readField(bs, &reply)
+	if err != nil {
+		return
+	}
+	err = readField(bs, &spread)
+	if err != nil {
+		return
+	}
+	err = readField(bs, &downstream)
+	if err != nil {
+		return
+	}
+	err = readField(bs, &bbs)
+	if err != nil {
+		return
+	}
+
+	c.IsReply = reply != 0
+	c.IsSpread = spread != 0
+	c.IsDownstream = downstream != 0
+	c.IsBbs = bbs != 0
+
+	err = readField(bs, &c.Id)
+	if err != nil {
+		return
+	}
+
+	var keywordLen byte
+	err = readField(bs, &keywordLen)
+	if err != nil {
+		return
+	}
+	keyword := make([]byte, keywordLen)
+	err = readField(bs, keyword[:])
+	if err != nil {
+		return
+	}
+	c.Keyword, err = toUtf8(keyword)
+	if err != nil {
+		return
+	}
+
+	err = readField(bs, c.Trip[:])
+	if err != nil {
+		return
+	}
+
+	var nodesLen byte
+	err = readField(bs, &nodesLen)
+	if err != nil {
+		return
+	}
+
+	c.Nodes = make([]NodeAddr, nodesLen)
+	for i := 0; i < int(nodesLen); i++ {
+		err = c.Nodes[i].UnmarshalStream(bs)
+		if err != nil {
+			return
+		}
+	}
+
+	var keysLen uint16
+	err = readField(bs, &keysLen)
+	if err != nil {
+		return
+	}
+	if keysLen > MaxQueryKeys {
+		err = fmt.Errorf("%w: too many keys: %d", ErrInvalid, keysLen)
+		return
+	}
+	// Keys with undecodable file names are dropped rather than failing the whole query,
+	// because they may be created by other clients and only relayed by the sender.
+	c.Keys = make([]FileKey, 0, keysLen)
+	for i := 0; i < int(keysLen); i++ {
+		var k FileKey
+		err = k.UnmarshalStream(bs)
+		if errors.Is(err, ErrEncoding) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		c.Keys = append(c.Keys, k)
+	}
+
+	err = checkTrailing(bs)
+	return
+}
+
+// Size of the blocks of the files transferred by CacheReq and CacheRes.
+const BlockSize = 0x10000
+
+// Length of the fields of CacheRes preceding Data.
+const cacheResHeaderLen = 24
+
+// CacheRes carries a block of the file requested by CacheReq.
+// Data is shorter than BlockSize only for the last block of the file.
+type CacheRes struct {
+	Id       uint32
+	BeginIdx uint32
+	Hash     [16]byte
+	Data     []byte
+}
+
+func (c *CacheRes) Marshal() (b []byte, err error) {
+	return c.AppendPayload(make([]byte, 0, cacheResHeaderLen+len(c.Data)))
+}
+
+func (c *CacheRes) AppendPayload(b []byte) (_ []byte, err error) {
+	if len(c.Data) > BlockSize {
+		return nil, errors.New(fmt.Sprintf("block too long: %d", len(c.Data)))
+	}
+	bs := bytes.NewBuffer(b)
+	w := &leWriter{w: bs}
+	w.write(c.Id)
+	w.write(c.BeginIdx)
+	w.write(c.Hash[:])
+	bs.Write(c.Data)
+	return bs.Bytes(), w.err
+}
+
+func (c *CacheRes) Unmarshal(b []byte) (err error) {
+	bs := bytes.NewBuffer(b)
+	err = readField(bs, &c.Id)
+	if err != nil {
+		return
+	}
+	err = readField(bs, &c.BeginIdx)
+	if err != nil {
+		return
+	}
+	err = readField(bs, c.Hash[:])
+	if err != nil {
+		return
+	}
+
+	// The rest of the frame is the block.
+	if bs.Len() > BlockSize {
+		return fmt.Errorf("%w: block too long: %d", ErrInvalid, bs.Len())
+	}
+	c.Data = append([]byte(nil), bs.Bytes()...)
+	return
+}
+
+// Returns the length of the block at the index of the file with the size,
+// or -1 if the index is out of the file.
+func BlockLen(size uint32, idx uint32) int {
+	begin := uint64(idx) * BlockSize
+	if begin >= uint64(size) {
+		return -1
+	}
+	if rest := uint64(size) - begin; rest < BlockSize {
+		return int(rest)
+	}
+	return BlockSize
+}
+
+// Validates the response against the request.
+func (c *CacheRes) Validate(req *CacheReq) error {
+	if c.Id != req.Id {
+		return errors.New(fmt.Sprintf("id mismatch: %d vs %d", c.Id, req.Id))
+	}
+	if c.Hash != req.Hash {
+		return errors.New("hash mismatch")
+	}
+	if c.BeginIdx < req.BeginIdx || c.BeginIdx-req.BeginIdx >= req.Num {
+		return errors.New(fmt.Sprintf("block %d not requested", c.BeginIdx))
+	}
+	if expected := BlockLen(req.Size, c.BeginIdx); len(c.Data) != expected {
+		return errors.New(fmt.Sprintf("invalid block length: %d, expected %d", len(c.Data), expected))
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package proto
+
+import (
+	"crypto/rc4"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var queryPayloads = [][]byte{
+	[]byte{
+		0x0, 0x0, 0x1, 0x0, 0x9b, 0x30, 0x1, 0x0, 0x21, 0x25, 0x65, 0x61, 0x64, 0x34, 0x31, 0x64,
+		0x34, 0x37, 0x66, 0x61, 0x63, 0x38, 0x30, 0x39, 0x62, 0x39, 0x61, 0x66, 0x64, 0x36, 0x32,
+		0x65, 0x66, 0x62, 0x30, 0x35, 0x31, 0x35, 0x37, 0x62, 0x32, 0x66, 0x0, 0x0, 0x0, 0x0, 0x0,
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1, 0xc0, 0xa8, 0x0, 0x2, 0x28, 0x2d, 0x0, 0x0},
+
+	// TODO(peryaudo): This example is ethically really really bad, so replace before publishing the source code.
+	[]byte{
+		0x0,                // IsReply
+		0x1,                // IsSpread
+		0x1,                // IsDownstream
+		0x0,                // IsBbs
+		0x4, 0x3, 0x0, 0x0, // Id
+		0x0,                                                   // keywordLen
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // Trip [11]byte
+		0x0,      // nodesLen
+		0x1, 0x0, // keysLen
+
+		// Begin queryKey struct
+		0x76, 0x6a, 0x9c, 0x5f, 0x3f, 0x1e, // Node
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // BbsNode
+		0x4, 0xb8, 0x4d, 0x23, // Size
+		0x2a, 0x66, 0x62, 0x44, 0xda, 0x9c, 0x16, 0x2, // Hash
+		0x72, 0x79, 0xfc, 0x3f, 0xaa, 0x46, 0x3c, 0x2c, // ...
+		0x42,       // fileNameLen = 66
+		0x1d, 0x1c, // checksum
+		0xc8, 0xe0, 0x9d, 0x5d, 0x73, 0x1, 0x3e, 0xcd, 0x4f, 0x51, // FileName
+		0xce, 0xab, 0xd6, 0xbd, 0x36, 0xf1, 0x7c, 0xaa, 0x9a, 0xe2, // ...
+		0x6d, 0x2d, 0x89, 0x80, 0x7e, 0xeb, 0x6a, 0xdb, 0xf1, 0xee,
+		0x57, 0x3e, 0x4, 0x43, 0xb6, 0xdb, 0x38, 0x32, 0xfd, 0x29,
+		0xae, 0xf8, 0x99, 0xfc, 0x79, 0x8f, 0xc5, 0x6f, 0x34, 0x23,
+		0x3c, 0x9d, 0x1b, 0xb0, 0x18, 0xb7, 0xa6, 0xc2, 0x15, 0x6b,
+		0xd9, 0xd3, 0x1f, 0x92, 0xc1, 0xf2,
+		0x6d, 0x37, 0x47, 0x67, 0x59, 0x6a, 0x68, 0x49, 0x69, 0x55, 0x0, // Trip
+		0x0,       // bbsTripLen
+		0x14, 0x2, // Ttl
+		0xd5, 0x29, 0x1c, 0x0, // RefCnt
+		0xd, 0x16, 0x2a, 0x55, // Timestamp
+		0x0, // IsIgnored
+		0x4, // KeyVer
+	}}
+
+func TestCmdQuery(t *testing.T) {
+	for _, expected := range queryPayloads {
+		var q Query
+		err := q.Unmarshal(expected)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		actual, err := q.Marshal()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		t.Logf("%#v", q)
+		if len(actual) != len(expected) {
+			t.Errorf("len mismatch %d vs %d expected %#v actual %#v", len(expected), len(actual), expected, actual)
+			return
+		}
+		for i := 0; i < len(actual); i++ {
+			if actual[i] != expected[i] {
+				t.Errorf("byte mismatch expected %#v actual %#v", expected, actual)
+				return
+			}
+		}
+	}
+
+}
+
+var addrPayloads = [][]byte{
+	[]byte{
+		0x99, 0xe0, 0xd1, 0x88, 0x7a, 0x24, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+		0x78, 0x0, 0x0, 0x0, 0x6, 0x3, 0xa, 0x83, 0x41, 0x83, 0x6a, 0x83, 0x81,
+		0x6d, 0x70, 0x34, 0x31, 0x38, 0x8b, 0xd6, 0x83, 0x51, 0x81, 0x5b, 0x83, 0x80}}
+
+func TestCmdAddr(t *testing.T) {
+	for _, expected := range addrPayloads {
+		var a Addr
+		err := a.Unmarshal(expected)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		actual, err := a.Marshal()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(actual) != len(expected) {
+			t.Errorf("len mismatch expected %#v actual %#v", expected, actual)
+			return
+		}
+		for i := 0; i < len(actual); i++ {
+			if actual[i] != expected[i] {
+				t.Errorf("byte mismatch expected %#v actual %#v", expected, actual)
+				return
+			}
+		}
+	}
+}
+
+var spreadCondPayloads = [][]byte{
+	[]byte{0x83, 0x77, 0x83, 0x41, 0x20, 0x2d, 0x83, 0x41, 0x83, 0x6a, 0x83, 0x81, 0x20, 0x2d, 0x31, 0x38,
+		0x8b, 0xd6, 0x83, 0x51, 0x81, 0x5b, 0x83, 0x80, 0x20, 0x2d, 0x93, 0xaf, 0x90, 0x6c, 0x20, 0x2d,
+		0x8f, 0xac, 0x90, 0xe0, 0x20, 0x2d, 0x41, 0x4e, 0x49, 0x4d, 0x45, 0x20, 0x2d, 0x93, 0xc1, 0x8e,
+		0x42, 0x0, 0x0, 0x38, 0x77, 0x15, 0x1, 0x0, 0xec, 0x12, 0x0, 0x8f, 0x4, 0xd2, 0x77, 0x0,
+		0x30, 0xd0, 0x1, 0x24, 0xe9, 0x12, 0x0, 0x1b, 0x94, 0x41, 0x0, 0x30, 0xe9, 0x12, 0x0, 0x0,
+		0x30, 0xd0, 0x1, 0x40, 0xe9, 0x12, 0x0, 0x87, 0x50, 0x4d, 0x0, 0x8, 0x71, 0xd0, 0x1, 0x34,
+		0xb0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x78,
+		0xea, 0x12, 0x0, 0x9, 0xa5, 0x4d, 0x0, 0x0, 0x0, 0x0, 0x0, 0x8, 0x71, 0xd0, 0x1, 0xa4,
+		0xea, 0x12, 0x0, 0xb7, 0x52, 0x4d, 0x0, 0x34, 0xb0, 0x0, 0x0, 0xa4, 0xea, 0x12, 0x0, 0x8,
+		0x71, 0xd0, 0x1, 0x78, 0x75, 0x15, 0x1, 0x84, 0xe9, 0x12, 0x0, 0xa, 0x0, 0x0, 0x0, 0x6d,
+		0xee, 0x12, 0x0, 0x97, 0xe9, 0x12, 0x0, 0xd8, 0xe9, 0x12, 0x0, 0x18, 0xfa, 0x52, 0x0, 0xa,
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x24, 0x0, 0x0, 0x0, 0xe5, 0x98, 0x53, 0x0, 0x64,
+		0xd, 0x4f, 0x0, 0x3, 0x0, 0x1, 0x77, 0x0, 0x0, 0x0, 0x0, 0x58, 0xd3, 0x17, 0x0, 0x1,
+		0x0, 0x0, 0x0, 0x98, 0xe9, 0x12, 0x0, 0xe0, 0xe9, 0x12, 0x0, 0x24, 0x0, 0x0, 0x0, 0x4c,
+		0xef, 0x12, 0x0, 0xd0, 0xe9, 0x12, 0x0, 0x48, 0xbf, 0x52, 0x0, 0x5c, 0xef, 0x12, 0x0, 0x4,
+		0xea, 0x12, 0x0, 0x9, 0x0, 0x0, 0x0, 0xe6, 0x98, 0x53, 0x0, 0x4, 0xea, 0x12, 0x0, 0xec,
+		0x0, 0x12, 0x0, 0xd7, 0xc2, 0x52, 0x0, 0x4, 0xea, 0x12, 0x0, 0x9, 0x0, 0x0, 0x0, 0x4c,
+		0x3e, 0xae, 0x0, 0x0}}
+
+func TestCmdSpreadCond(t *testing.T) {
+	for _, expected := range spreadCondPayloads {
+		var s SpreadCond
+		err := s.Unmarshal(expected)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		actual, err := s.Marshal()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(actual) != len(expected) {
+			t.Errorf("len mismatch expected %d vs %d %#v actual %#v", len(expected), len(actual), expected, actual)
+			return
+		}
+		for i := 0; i < len(actual); i++ {
+			if actual[i] != expected[i] {
+				t.Errorf("byte mismatch expected %#v actual %#v", expected, actual)
+				return
+			}
+		}
+	}
+}
+
+func TestCacheRes(t *testing.T) {
+	req := &CacheReq{Id: 1, BeginIdx: 1, Num: 2, Hash: [16]byte{2}, Size: 2*BlockSize + 100}
+
+	// The last block is shorter.
+	res := &CacheRes{Id: 1, BeginIdx: 2, Hash: [16]byte{2}, Data: make([]byte, 100)}
+	b, err := res.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded CacheRes
+	if err := decoded.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Data) != 100 {
+		t.Errorf("expected 100 bytes, got %d", len(decoded.Data))
+	}
+	if err := decoded.Validate(req); err != nil {
+		t.Error(err)
+	}
+
+	invalids := []*CacheRes{
+		{Id: 2, BeginIdx: 2, Hash: [16]byte{2}, Data: make([]byte, 100)},
+		{Id: 1, BeginIdx: 2, Hash: [16]byte{3}, Data: make([]byte, 100)},
+		{Id: 1, BeginIdx: 0, Hash: [16]byte{2}, Data: make([]byte, BlockSize)},
+		{Id: 1, BeginIdx: 3, Hash: [16]byte{2}, Data: make([]byte, 100)},
+		{Id: 1, BeginIdx: 1, Hash: [16]byte{2}, Data: make([]byte, 100)},
+	}
+	for i, res := range invalids {
+		if err := res.Validate(req); err == nil {
+			t.Errorf("%d: expected an error", i)
+		}
+	}
+
+	tooLong := &CacheRes{Data: make([]byte, BlockSize+1)}
+	if _, err := tooLong.Marshal(); err == nil {
+		t.Error("expected an error for the too long block")
+	}
+	if err := decoded.Unmarshal(make([]byte, cacheResHeaderLen+BlockSize+1)); err == nil {
+		t.Error("expected an error for the too long block")
+	}
+
+	for _, c := range []struct {
+		size     uint32
+		idx      uint32
+		expected int
+	}{
+		{BlockSize, 0, BlockSize},
+		{BlockSize, 1, -1},
+		{BlockSize + 1, 1, 1},
+		{0, 0, -1},
+	} {
+		if l := BlockLen(c.size, c.idx); l != c.expected {
+			t.Errorf("BlockLen(%d, %d): expected %d, got %d", c.size, c.idx, c.expected, l)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	key := FileKey{FileName: "abc", Timestamp: 1}
+	query, err := (&Query{Keys: []FileKey{key}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the checksum of the file name, which follows the query header (23 bytes),
+	// the node addresses (12 bytes), the size, the hash and the file name length.
+	badChecksum := append([]byte{}, query...)
+	badChecksum[23+12+4+16+1]++
+
+	// The number of the keys is at the end of the query without keys.
+	tooManyKeys, err := (&Query{}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tooManyKeys[len(tooManyKeys)-2], tooManyKeys[len(tooManyKeys)-1] = 0xff, 0xff
+
+	addr, err := (&Addr{Clusters: [3]string{"a", "b", "c"}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last byte of the clusters is a lead byte without the trail byte.
+	badEncoding := append([]byte{}, addr...)
+	badEncoding[len(badEncoding)-1] = 0x81
+
+	for _, c := range []struct {
+		idx      byte
+		payload  []byte
+		expected error
+	}{
+		{IdxSpeed, []byte{0, 0}, ErrTruncated},
+		{IdxSpeed, []byte{0, 0, 0, 0, 0}, ErrTrailing},
+		{IdxClose, []byte{0}, ErrTrailing},
+		{IdxAddr, addr[:len(addr)-1], ErrTruncated},
+		{IdxAddr, append(addr, 0), ErrTrailing},
+		{IdxAddr, badEncoding, ErrEncoding},
+		{IdxQuery, query[:len(query)-1], ErrTruncated},
+		{IdxQuery, badChecksum, ErrChecksum},
+		{IdxQuery, tooManyKeys, ErrInvalid},
+	} {
+		_, err := Parse(c.idx, c.payload)
+		decodeErr, ok := err.(*DecodeError)
+		if !ok {
+			t.Errorf("command %d: expected DecodeError, got %v", c.idx, err)
+			continue
+		}
+		if decodeErr.Idx != int(c.idx) {
+			t.Errorf("command %d: wrong index %d", c.idx, decodeErr.Idx)
+		}
+		if !errors.Is(err, c.expected) {
+			t.Errorf("command %d: expected %v, got %v", c.idx, c.expected, err)
+		}
+	}
+
+	// Lengths not fitting in the length fields are refused.
+	if _, err := (&Query{Keyword: strings.Repeat("a", 256)}).Marshal(); err == nil {
+		t.Error("expected an error for the too long keyword")
+	}
+	if _, err := (&Addr{Clusters: [3]string{strings.Repeat("a", 256)}}).Marshal(); err == nil {
+		t.Error("expected an error for the too long cluster")
+	}
+}
+
+func TestQuerySkipsBadEncoding(t *testing.T) {
+	query, err := (&Query{Keys: []FileKey{{FileName: "a"}, {FileName: "b"}}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the file name of the first key with a lead byte without the trail byte,
+	// keeping the checksum valid. The name length, the checksum and the name follow
+	// the query header (23 bytes), the node addresses (12 bytes), the size and the hash.
+	offset := 23 + 12 + 4 + 16
+	name := []byte{0x81}
+	query[offset+1], query[offset+2] = 0x81, 0
+	cip, _ := rc4.NewCipher([]byte{0x81})
+	cip.XORKeyStream(query[offset+3:offset+4], name)
+
+	c, err := Parse(IdxQuery, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := c.(*Query).Keys
+	if len(keys) != 1 || keys[0].FileName != "b" {
+		t.Errorf("unexpected keys: %#v", keys)
+	}
+}
@@ -0,0 +1,141 @@
+package proto
+
+import (
+	"crypto/rc4"
+	"errors"
+	"io"
+)
+
+// This file implements the decoder of captured Winny sessions.
+//
+// Each side of a Winny connection sends six random bytes first, whose last four bytes
+// are the RC4 key of the stream. Compat and ProtoHdr are encrypted with the key,
+// and the rest of the stream is encrypted with the key shuffled by ShuffleKey.
+// Both directions are independent, so each of them is decoded by its own StreamDecoder.
+
+// DecodedCmd is a command decoded from a captured stream.
+type DecodedCmd struct {
+	// Offset of the command in the raw stream, including the leading random bytes.
+	Offset int64
+
+	Idx  int
+	Name string
+	Cmd  Command
+
+	// The *DecodeError if the payload is invalid, in which case Cmd is parsed only partially.
+	Err error
+}
+
+// StreamDecoder decrypts and parses the commands of one direction of a Winny session.
+type StreamDecoder struct {
+	r      io.Reader
+	cip    *rc4.Cipher
+	key    []byte
+	offset int64
+
+	shuffled bool
+}
+
+// Returns a StreamDecoder reading the raw TCP byte stream from r.
+func NewStreamDecoder(r io.Reader) *StreamDecoder {
+	return &StreamDecoder{r: r}
+}
+
+// Returns the number of bytes consumed from the raw stream.
+func (d *StreamDecoder) Offset() int64 {
+	return d.offset
+}
+
+func (d *StreamDecoder) Read(b []byte) (n int, err error) {
+	n, err = d.r.Read(b)
+	if d.cip != nil {
+		d.cip.XORKeyStream(b[:n], b[:n])
+	}
+	d.offset += int64(n)
+	return
+}
+
+// Returns the next command in the stream. It returns io.EOF at the end of the stream.
+// If the payload of a command is invalid, both the command and the error are returned,
+// and the decoder can continue. It cannot continue after other errors.
+func (d *StreamDecoder) Next() (c *DecodedCmd, err error) {
+	if d.key == nil {
+		var rnd [6]byte
+		err = readLE(d, rnd[:])
+		if err != nil {
+			return
+		}
+		d.key = rnd[2:]
+		d.cip = NewStreamCipher(d.key)
+	}
+
+	offset := d.offset
+	cmd, err := Decode(d)
+	if cmd == nil {
+		return
+	}
+
+	c = &DecodedCmd{Offset: offset, Idx: cmd.Idx(), Name: Name(cmd), Cmd: cmd}
+	var decodeErr *DecodeError
+	if errors.As(err, &decodeErr) {
+		c.Err = err
+	}
+
+	if cmd.Idx() == IdxProtoHdr && !d.shuffled {
+		ShuffleKey(d.key)
+		d.cip = NewStreamCipher(d.key)
+		d.shuffled = true
+	}
+	return
+}
+
+// Decodes both directions of a captured session.
+// fn is called for each command with the index of the stream (0 for a and 1 for b),
+// and the decoding stops when fn returns an error.
+// Commands with invalid payloads are passed to fn with DecodedCmd.Err set.
+// Commands are not interleaved because the raw streams have no timestamps.
+func DecodeSession(a, b io.Reader, fn func(stream int, c *DecodedCmd) error) error {
+	for i, r := range []io.Reader{a, b} {
+		d := NewStreamDecoder(r)
+		for {
+			c, err := d.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil && (c == nil || c.Err == nil) {
+				return err
+			}
+			err = fn(i, c)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Creates the RC4 cipher of a stream from the last four of the six random bytes sent first.
+func NewStreamCipher(key []byte) *rc4.Cipher {
+	cip, _ := rc4.NewCipher(strlenWorkaround(key))
+	return cip
+}
+
+// Derives in place the key used after ProtoHdr.
+func ShuffleKey(key []byte) {
+	for i := 1; i < 4; i++ {
+		key[i] ^= 0x39
+	}
+}
+
+// Imitating Winny's infamous usage of strlen
+func strlenWorkaround(b []byte) []byte {
+	if b[0] == 0 {
+		return b[0:1]
+	}
+	for i := 1; i < len(b); i++ {
+		if b[i] == 0 {
+			return b[0:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,125 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// encryptingWriter encrypts the stream in the same way as rc4Conn.
+type encryptingWriter struct {
+	w   io.Writer
+	cip *rc4.Cipher
+}
+
+func (e *encryptingWriter) Write(b []byte) (int, error) {
+	enc := make([]byte, len(b))
+	e.cip.XORKeyStream(enc, b)
+	return e.w.Write(enc)
+}
+
+// shortSpeed is a Speed with a truncated payload.
+type shortSpeed struct{ Speed }
+
+func (c *shortSpeed) Marshal() ([]byte, error) { return []byte{1}, nil }
+
+// encodeStream encodes the commands as a side of a Winny session does.
+// The first two commands must be Compat and ProtoHdr.
+func encodeStream(t *testing.T, rnd [6]byte, cmds []Command) []byte {
+	var raw bytes.Buffer
+	raw.Write(rnd[:])
+
+	key := append([]byte{}, rnd[2:]...)
+	w := &encryptingWriter{w: &raw, cip: NewStreamCipher(key)}
+	for i, c := range cmds {
+		if i == 2 {
+			ShuffleKey(key)
+			w.cip = NewStreamCipher(key)
+		}
+		if err := Encode(w, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return raw.Bytes()
+}
+
+func TestStreamDecoder(t *testing.T) {
+	cmds := []Command{
+		&Compat{},
+		&ProtoHdr{Ver: 12710, CertStr: "Winny Ver2.0b1"},
+		&Speed{Speed: 1000},
+		&ConnType{Type: 1},
+		&SelfAddr{IP: [4]byte{1, 2, 3, 4}, Port: 4504, Clusters: [3]string{"a", "b", "c"}},
+		&Close{}}
+
+	// The key containing NUL is truncated by strlenWorkaround.
+	for _, rnd := range [][6]byte{{1, 2, 3, 4, 5, 6}, {1, 2, 3, 0, 5, 6}} {
+		raw := encodeStream(t, rnd, cmds)
+
+		d := NewStreamDecoder(bytes.NewReader(raw))
+		for i, expected := range cmds {
+			c, err := d.Next()
+			if err != nil {
+				t.Fatalf("command %d: %v", i, err)
+			}
+			if c.Idx != expected.Idx() {
+				t.Errorf("command %d: expected index %d, got %d", i, expected.Idx(), c.Idx)
+			}
+			if !reflect.DeepEqual(c.Cmd, expected) {
+				t.Errorf("command %d: expected %+v, got %+v", i, expected, c.Cmd)
+			}
+		}
+		if _, err := d.Next(); err != io.EOF {
+			t.Errorf("expected io.EOF, got %v", err)
+		}
+		if d.Offset() != int64(len(raw)) {
+			t.Errorf("expected offset %d, got %d", len(raw), d.Offset())
+		}
+	}
+}
+
+func TestDecodeSession(t *testing.T) {
+	a := encodeStream(t, [6]byte{1, 2, 3, 4, 5, 6}, []Command{&Compat{}, &ProtoHdr{Ver: 12710}, &Speed{Speed: 100}})
+	b := encodeStream(t, [6]byte{6, 5, 4, 3, 2, 1}, []Command{&Compat{}, &ProtoHdr{Ver: 12710}})
+
+	var names []string
+	err := DecodeSession(bytes.NewReader(a), bytes.NewReader(b), func(stream int, c *DecodedCmd) error {
+		names = append(names, string('a'+byte(stream))+":"+c.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"a:Compat", "a:ProtoHdr", "a:Speed", "b:Compat", "b:ProtoHdr"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	// Invalid payloads are reported by DecodedCmd.Err and the decoding continues.
+	c := encodeStream(t, [6]byte{1, 2, 3, 4, 5, 6}, []Command{&Compat{}, &ProtoHdr{Ver: 12710}, &shortSpeed{}, &Close{}})
+	names = nil
+	err = DecodeSession(bytes.NewReader(c), bytes.NewReader(b), func(stream int, c *DecodedCmd) error {
+		name := string('a'+byte(stream)) + ":" + c.Name
+		if c.Err != nil {
+			name += "!"
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{"a:Compat", "a:ProtoHdr", "a:Speed!", "a:Close", "b:Compat", "b:ProtoHdr"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected %v, got %v", expected, names)
+	}
+
+	// Truncated streams are errors.
+	err = DecodeSession(bytes.NewReader(a[:len(a)-1]), bytes.NewReader(b), func(int, *DecodedCmd) error { return nil })
+	if err == nil {
+		t.Error("expected an error for the truncated stream")
+	}
+}
@@ -0,0 +1,75 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Causes of DecodeError. Use errors.Is to classify the errors.
+var (
+	// The payload ends in the middle of a field.
+	ErrTruncated = errors.New("truncated payload")
+	// The checksum of a field does not match.
+	ErrChecksum = errors.New("checksum mismatch")
+	// A string is not valid Shift-JIS.
+	ErrEncoding = errors.New("invalid encoding")
+	// Bytes remain after the last field.
+	ErrTrailing = errors.New("trailing bytes")
+	// A field has an impossible value.
+	ErrInvalid = errors.New("invalid value")
+)
+
+// DecodeError indicates that the payload of the command cannot be decoded.
+// Parse and Decode return it for the errors of Unmarshal.
+type DecodeError struct {
+	Idx int
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decoding command %d: %v", e.Idx, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// readField reads a field of a payload, reporting the end of the payload as ErrTruncated.
+func readField(r io.Reader, data interface{}) error {
+	err := readLE(r, data)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
+
+// checkTrailing returns ErrTrailing if the payload is not consumed completely.
+func checkTrailing(bs *bytes.Buffer) error {
+	if bs.Len() > 0 {
+		return fmt.Errorf("%w: %d bytes", ErrTrailing, bs.Len())
+	}
+	return nil
+}
+
+// checkLen returns an error if the length of the field does not fit in the length field.
+func checkLen(name string, n int, max int) error {
+	if n > max {
+		return errors.New(fmt.Sprintf("%s too long: %d", name, n))
+	}
+	return nil
+}
+
+// leWriter writes little endian values and remembers the first error,
+// so that marshaling can check the error once at the end.
+type leWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *leWriter) write(data interface{}) {
+	if w.err == nil {
+		w.err = writeLE(w.w, data)
+	}
+}
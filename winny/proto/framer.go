@@ -0,0 +1,152 @@
+package proto
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// Length of the frame header; the length of the rest of the frame (uint32) and the command index.
+const frameHeaderLen = 5
+
+// Buffers larger than this are not returned to the pool,
+// so that occasional huge frames do not pin memory.
+const maxPooledBufLen = 128 * 1024
+
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+// getBuf returns a buffer of length n from the pool.
+func getBuf(n int) *[]byte {
+	b := bufPool.Get().(*[]byte)
+	if cap(*b) < n {
+		*b = make([]byte, n)
+	}
+	*b = (*b)[:n]
+	return b
+}
+
+func putBuf(b *[]byte) {
+	if cap(*b) > maxPooledBufLen {
+		return
+	}
+	bufPool.Put(b)
+}
+
+// Appender is implemented by the commands which can marshal their payloads
+// into an existing buffer. Framer uses it to avoid allocating a buffer for every command.
+type Appender interface {
+	// Appends the payload to b and returns the extended buffer.
+	AppendPayload(b []byte) ([]byte, error)
+}
+
+// Framer reads and writes frames with buffers shared among the Framers.
+//
+// Reading and writing may happen concurrently, but neither of them is safe for concurrent use by itself.
+type Framer struct {
+	r io.Reader
+	w io.Writer
+
+	hdr  [frameHeaderLen]byte
+	rbuf *[]byte
+}
+
+// Returns a Framer reading from r and writing to w. Either of them may be nil if unused.
+func NewFramer(r io.Reader, w io.Writer) *Framer {
+	return &Framer{r: r, w: w}
+}
+
+// Reads a frame and returns its command index and payload.
+// The payload is only valid until the next call of ReadFrame or ReadCommand.
+// The limits of the frame length are the same as the ReadFrame function.
+func (f *Framer) ReadFrame() (idx byte, payload []byte, err error) {
+	f.release()
+
+	_, err = io.ReadFull(f.r, f.hdr[:4])
+	if err != nil {
+		return
+	}
+	length := binary.LittleEndian.Uint32(f.hdr[:4])
+	if length == 0 {
+		err = &FrameError{Idx: -1, Msg: "empty frame"}
+		return
+	}
+	_, err = io.ReadFull(f.r, f.hdr[4:])
+	if err != nil {
+		err = noEOF(err)
+		return
+	}
+	idx = f.hdr[4]
+	err = checkFrameLen(idx, length)
+	if err != nil {
+		return
+	}
+
+	f.rbuf = getBuf(int(length - 1))
+	payload = *f.rbuf
+	_, err = io.ReadFull(f.r, payload)
+	if err != nil {
+		err = noEOF(err)
+		payload = nil
+		f.release()
+	}
+	return
+}
+
+// Reads a frame and parses the command in it.
+// Unlike the payloads returned by ReadFrame, the command can be retained.
+// If the frame is read but its payload is invalid, both the command and the error are returned.
+func (f *Framer) ReadCommand() (c Command, err error) {
+	idx, payload, err := f.ReadFrame()
+	if err != nil {
+		return
+	}
+	c, err = Parse(idx, payload)
+	f.release()
+	return
+}
+
+// release returns the buffer of the last frame to the pool.
+func (f *Framer) release() {
+	if f.rbuf != nil {
+		putBuf(f.rbuf)
+		f.rbuf = nil
+	}
+}
+
+// Writes the command as a frame with a single Write call.
+func (f *Framer) WriteCommand(c Command) (err error) {
+	buf := getBuf(frameHeaderLen)
+	defer putBuf(buf)
+
+	b := *buf
+	if a, ok := c.(Appender); ok {
+		b, err = a.AppendPayload(b)
+	} else {
+		var payload []byte
+		payload, err = c.Marshal()
+		b = append(b, payload...)
+	}
+	if err != nil {
+		return
+	}
+	*buf = b
+
+	binary.LittleEndian.PutUint32(b[:4], uint32(len(b)-frameHeaderLen+1))
+	b[4] = byte(c.Idx())
+
+	_, err = f.w.Write(b)
+	return
+}
+
+// noEOF converts io.EOF in the middle of a frame into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// countingWriter counts the Write calls.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(b)
+}
+
+func TestFramer(t *testing.T) {
+	cmds := []Command{
+		&Speed{Speed: 120},
+		&CacheRes{Id: 1, BeginIdx: 2, Hash: [16]byte{3}, Data: []byte{4, 5, 6}},
+		&Query{Id: 7, Keyword: "foo", Nodes: []NodeAddr{}, Keys: []FileKey{}},
+		&Close{}}
+
+	var w countingWriter
+	f := NewFramer(nil, &w)
+	for _, c := range cmds {
+		if err := f.WriteCommand(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.writes != len(cmds) {
+		t.Errorf("expected %d writes, got %d", len(cmds), w.writes)
+	}
+
+	// Framer and the package level functions are interchangeable.
+	raw := w.Bytes()
+	r := NewFramer(bytes.NewReader(raw), nil)
+	for _, expected := range cmds {
+		c, err := r.ReadCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c, expected) {
+			t.Errorf("expected %+v, got %+v", expected, c)
+		}
+	}
+	if _, err := r.ReadCommand(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+
+	var buf bytes.Buffer
+	for _, c := range cmds {
+		if err := Encode(&buf, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), raw) {
+		t.Error("Encode and Framer.WriteCommand differ")
+	}
+
+	// Truncated frames
+	r = NewFramer(bytes.NewReader(raw[:len(raw)-2]), nil)
+	var err error
+	for err == nil {
+		_, err = r.ReadCommand()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestFramerAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool does not keep the buffers under the race detector")
+	}
+
+	var raw bytes.Buffer
+	if err := Encode(&raw, &Speed{Speed: 120}); err != nil {
+		t.Fatal(err)
+	}
+
+	br := bytes.NewReader(raw.Bytes())
+	f := NewFramer(br, io.Discard)
+	allocs := testing.AllocsPerRun(100, func() {
+		br.Reset(raw.Bytes())
+		if _, _, err := f.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.WriteCommand(&Close{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
@@ -0,0 +1,172 @@
+package proto
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// This file contains the fuzz targets of the decoders.
+// The seed corpus consists of the payloads captured from the real traffic in cmds_test.go
+// and the payloads of sample commands.
+//
+//	go test -fuzz FuzzParse ./winny/proto
+
+var sampleCmds = []Command{
+	&ProtoHdr{Ver: 12710, CertStr: "Winny Ver2.0b1"},
+	&Speed{Speed: 1000},
+	&ConnType{Type: ConnTypeSearch, IsBbs: true},
+	&SelfAddr{IP: [4]byte{1, 2, 3, 4}, Port: 4504, Ddns: "example.com", Clusters: [3]string{"a", "b", "c"}},
+	&Addr{IP: [4]byte{1, 2, 3, 4}, Port: 4504, Speed: 120, Clusters: [3]string{"a", "b", "c"}},
+	&Spread{},
+	&CacheReq{Id: 1, Num: 1, Size: 100},
+	&SpreadCond{Id: 1},
+	&Query{Id: 1, Keyword: "foo", Nodes: []NodeAddr{{Port: 1}}, Keys: []FileKey{{FileName: "foo.zip"}}},
+	&CacheRes{Id: 1, Data: []byte{1, 2, 3}},
+	&Close{},
+	&Compat{},
+}
+
+func samplePayloads(t testing.TB) (idxs []byte, payloads [][]byte) {
+	for _, c := range sampleCmds {
+		b, err := c.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		idxs = append(idxs, byte(c.Idx()))
+		payloads = append(payloads, b)
+	}
+	for _, b := range queryPayloads {
+		idxs = append(idxs, IdxQuery)
+		payloads = append(payloads, b)
+	}
+	for _, b := range addrPayloads {
+		idxs = append(idxs, IdxAddr)
+		payloads = append(payloads, b)
+	}
+	for _, b := range spreadCondPayloads {
+		idxs = append(idxs, IdxSpreadCond)
+		payloads = append(payloads, b)
+	}
+	return
+}
+
+// checkRemarshal checks that the command decoded successfully can be encoded
+// and the encoded payload can be decoded again.
+func checkRemarshal(t *testing.T, c Command) {
+	b, err := c.Marshal()
+	if err != nil {
+		// Decoded strings may not be encodable again.
+		return
+	}
+	if _, err := Parse(byte(c.Idx()), b); err != nil {
+		t.Errorf("decoding remarshaled %+v failed: %v", c, err)
+	}
+}
+
+func fuzzCommand(f *testing.F, idx byte) {
+	idxs, payloads := samplePayloads(f)
+	for i, b := range payloads {
+		if idxs[i] == idx {
+			f.Add(b)
+		}
+	}
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		c, err := Parse(idx, payload)
+		if err == nil {
+			checkRemarshal(t, c)
+		}
+	})
+}
+
+func FuzzProtoHdr(f *testing.F) { fuzzCommand(f, IdxProtoHdr) }
+func FuzzSelfAddr(f *testing.F) { fuzzCommand(f, IdxSelfAddr) }
+func FuzzAddr(f *testing.F)     { fuzzCommand(f, IdxAddr) }
+func FuzzQuery(f *testing.F)    { fuzzCommand(f, IdxQuery) }
+func FuzzCacheRes(f *testing.F) { fuzzCommand(f, IdxCacheRes) }
+
+func FuzzParse(f *testing.F) {
+	idxs, payloads := samplePayloads(f)
+	for i, b := range payloads {
+		f.Add(idxs[i], b)
+	}
+	f.Fuzz(func(t *testing.T, idx byte, payload []byte) {
+		c, err := Parse(idx, payload)
+		if err == nil {
+			checkRemarshal(t, c)
+		}
+	})
+}
+
+func FuzzFileKey(f *testing.F) {
+	var buf bytes.Buffer
+	k := &FileKey{Node: NodeAddr{IP: [4]byte{1, 2, 3, 4}, Port: 4504}, FileName: "foo.zip", BbsTrip: []byte{1}}
+	if err := k.MarshalStream(&buf); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var k FileKey
+		if err := k.UnmarshalStream(bytes.NewReader(b)); err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		if err := k.MarshalStream(&buf); err != nil {
+			return
+		}
+		var again FileKey
+		if err := again.UnmarshalStream(&buf); err != nil {
+			t.Errorf("decoding remarshaled %+v failed: %v", k, err)
+		}
+	})
+}
+
+func FuzzFramer(f *testing.F) {
+	var buf bytes.Buffer
+	for _, c := range sampleCmds {
+		if err := Encode(&buf, c); err != nil {
+			f.Fatal(err)
+		}
+	}
+	f.Add(buf.Bytes())
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, IdxQuery})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		// The Framer and the package level functions must agree.
+		r := bytes.NewReader(b)
+		fr := NewFramer(bytes.NewReader(b), nil)
+		for {
+			idx, payload, err := ReadFrame(r)
+			fidx, fpayload, ferr := fr.ReadFrame()
+			if (err == nil) != (ferr == nil) {
+				t.Fatalf("ReadFrame: %v, Framer.ReadFrame: %v", err, ferr)
+			}
+			if err != nil {
+				return
+			}
+			if idx != fidx || !bytes.Equal(payload, fpayload) {
+				t.Fatalf("frames differ")
+			}
+			Parse(idx, payload)
+		}
+	})
+}
+
+func FuzzStreamDecoder(f *testing.F) {
+	var raw bytes.Buffer
+	raw.Write([]byte{1, 2, 3, 4, 5, 6})
+	f.Add(raw.Bytes())
+	f.Add([]byte{1, 2, 0, 0, 0, 0, 1, 0, 0, 0, IdxCompat})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		d := NewStreamDecoder(bytes.NewReader(b))
+		for {
+			c, err := d.Next()
+			if err == io.EOF || (err != nil && c == nil) {
+				return
+			}
+		}
+	})
+}
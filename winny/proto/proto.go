@@ -0,0 +1,173 @@
+// Package proto implements the wire format of the Winny protocol.
+//
+// A Winny stream is a sequence of frames, each of which consists of
+// the length of the rest of the frame (uint32, little endian),
+// the command index (byte) and the payload of the command.
+// The streams are encrypted with RC4; see StreamDecoder for the key schedule.
+package proto
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// Command is a command of the Winny protocol.
+type Command interface {
+	// Returns the command index on the wire.
+	Idx() int
+	Marshal() (b []byte, err error)
+	// Unmarshal must not retain b, which may be reused after it returns.
+	Unmarshal(b []byte) (err error)
+}
+
+// Maximum lengths of the frames. CacheRes frames carry a block at most.
+const (
+	MaxFrameLen         = 1 * 1024 * 1024
+	MaxCacheResFrameLen = 1 + cacheResHeaderLen + BlockSize
+)
+
+// Maximum number of the keys in a Query.
+const MaxQueryKeys = 2000
+
+var registry = map[byte]func() Command{
+	IdxProtoHdr:   func() Command { return &ProtoHdr{} },
+	IdxSpeed:      func() Command { return &Speed{} },
+	IdxConnType:   func() Command { return &ConnType{} },
+	IdxSelfAddr:   func() Command { return &SelfAddr{} },
+	IdxAddr:       func() Command { return &Addr{} },
+	IdxSpread:     func() Command { return &Spread{} },
+	IdxCacheReq:   func() Command { return &CacheReq{} },
+	IdxSpreadCond: func() Command { return &SpreadCond{} },
+	IdxQuery:      func() Command { return &Query{} },
+	IdxCacheRes:   func() Command { return &CacheRes{} },
+
+	IdxClose:           func() Command { return &Close{} },
+	IdxCloseTransLimit: func() Command { return &CloseTransLimit{} },
+	IdxCloseBadPort0:   func() Command { return &CloseBadPort0{} },
+	IdxCloseIgnored:    func() Command { return &CloseIgnored{} },
+	IdxCloseSlow:       func() Command { return &CloseSlow{} },
+	IdxCloseForgery:    func() Command { return &CloseForgery{} },
+
+	IdxCompat: func() Command { return &Compat{} },
+}
+
+// Registers the constructor of the command with the index so that Decode and Parse can handle it.
+// It replaces the registered command with the same index, if any.
+// Register is not safe for concurrent use with decoding, so call it in init functions.
+func Register(idx byte, newCmd func() Command) {
+	registry[idx] = newCmd
+}
+
+// Returns an empty command with the index, or nil if the index is not registered.
+func New(idx byte) Command {
+	newCmd, ok := registry[idx]
+	if !ok {
+		return nil
+	}
+	return newCmd()
+}
+
+// Returns the name of the command such as "Query".
+func Name(c Command) string {
+	t := reflect.TypeOf(c)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// FrameError indicates that the frame header is invalid.
+type FrameError struct {
+	Idx int
+	Msg string
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("invalid frame of command %d: %s", e.Idx, e.Msg)
+}
+
+// Reads a frame and returns its command index and payload.
+// Frames longer than MaxFrameLen, or MaxCacheResFrameLen for CacheRes, are refused
+// without reading their payloads.
+func ReadFrame(r io.Reader) (idx byte, payload []byte, err error) {
+	var length uint32
+
+	err = readLE(r, &length)
+	if err != nil {
+		return
+	}
+	if length == 0 {
+		err = &FrameError{Idx: -1, Msg: "empty frame"}
+		return
+	}
+	err = readLE(r, &idx)
+	if err != nil {
+		return
+	}
+	err = checkFrameLen(idx, length)
+	if err != nil {
+		return
+	}
+
+	payload = make([]byte, length-1)
+	err = readLE(r, payload)
+	return
+}
+
+func checkFrameLen(idx byte, length uint32) error {
+	max := uint32(MaxFrameLen)
+	if idx == IdxCacheRes {
+		max = MaxCacheResFrameLen
+	}
+	if length > max {
+		return &FrameError{Idx: int(idx), Msg: "payload too long"}
+	}
+	return nil
+}
+
+// Writes the payload as a frame of the command index.
+func WriteFrame(w io.Writer, idx byte, payload []byte) (err error) {
+	length := uint32(len(payload) + 1)
+
+	err = writeLE(w, length)
+	if err != nil {
+		return
+	}
+	err = writeLE(w, idx)
+	if err != nil {
+		return
+	}
+	err = writeLE(w, payload)
+	return
+}
+
+// Parses the payload of the command index.
+// If the index is known but the payload is invalid, both the command and a *DecodeError are returned.
+func Parse(idx byte, payload []byte) (c Command, err error) {
+	c = New(idx)
+	if c == nil {
+		err = &FrameError{Idx: int(idx), Msg: "unknown command index"}
+		return
+	}
+	err = c.Unmarshal(payload)
+	if err != nil {
+		err = &DecodeError{Idx: int(idx), Err: err}
+	}
+	return
+}
+
+// Reads a frame and parses the command in it.
+// If the frame is read but its payload is invalid, both the command and the error are returned.
+func Decode(r io.Reader) (c Command, err error) {
+	idx, payload, err := ReadFrame(r)
+	if err != nil {
+		return
+	}
+	return Parse(idx, payload)
+}
+
+// Writes the command as a frame.
+func Encode(w io.Writer, c Command) (err error) {
+	return NewFramer(nil, w).WriteCommand(c)
+}
@@ -0,0 +1,70 @@
+package proto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	cmds := []Command{
+		&Speed{Speed: 120},
+		&CacheReq{Id: 1, BeginIdx: 2, Num: 3, Hash: [16]byte{4}, Size: 5},
+		&Query{Id: 7, Keyword: "foo", Nodes: []NodeAddr{{IP: [4]byte{1, 2, 3, 4}, Port: 4504}}, Keys: []FileKey{}},
+		&CloseSlow{}}
+
+	var buf bytes.Buffer
+	for _, c := range cmds {
+		if err := Encode(&buf, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range cmds {
+		c, err := Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c, expected) {
+			t.Errorf("expected %+v, got %+v", expected, c)
+		}
+	}
+}
+
+func TestReadFrameErrors(t *testing.T) {
+	frames := [][]byte{
+		{0, 0, 0, 0},                 // empty frame
+		{0, 0, 0x20, 0, IdxQuery},    // too long
+		{0, 0, 0, 0x10, IdxCacheRes}, // too long even for CacheRes
+		{2, 0, 0, 0, 0xff, 0},        // unknown index
+	}
+	for _, frame := range frames {
+		_, err := Decode(bytes.NewReader(frame))
+		if _, ok := err.(*FrameError); !ok {
+			t.Errorf("expected FrameError for %v, got %v", frame, err)
+		}
+	}
+}
+
+type testCmd struct{ noPayload }
+
+func (c *testCmd) Idx() int { return 0xfe }
+
+func TestRegister(t *testing.T) {
+	if New(0xfe) != nil {
+		t.Fatal("unregistered index returned a command")
+	}
+	Register(0xfe, func() Command { return &testCmd{} })
+	defer delete(registry, 0xfe)
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, &testCmd{}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Name(c) != "testCmd" {
+		t.Errorf("expected testCmd, got %s", Name(c))
+	}
+}
@@ -0,0 +1,252 @@
+package proto
+
+import (
+	"bytes"
+	"crypto/rc4"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/transform"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Basic Winny data structures
+
+// NodeAddr is the address of a node.
+type NodeAddr struct {
+	IP   [4]byte
+	Port int
+}
+
+// Returns the address in the host:port form.
+func (n NodeAddr) String() string {
+	return net.JoinHostPort(net.IP(n.IP[:]).String(), strconv.Itoa(n.Port))
+}
+
+func (n *NodeAddr) MarshalStream(w io.Writer) (err error) {
+	lw := &leWriter{w: w}
+	lw.write(n.IP[:])
+	lw.write(uint16(n.Port))
+	return lw.err
+}
+
+func (n *NodeAddr) UnmarshalStream(r io.Reader) (err error) {
+	err = readField(r, n.IP[:])
+	if err != nil {
+		return
+	}
+	var port uint16
+	err = readField(r, &port)
+	n.Port = int(port)
+	return
+}
+
+// FileKey is a key announcing that the node has the file.
+type FileKey struct {
+	Node      NodeAddr
+	BbsNode   NodeAddr
+	Size      uint32
+	Hash      [16]byte
+	FileName  string
+	Trip      [11]byte
+	BbsTrip   []byte
+	Ttl       uint16
+	RefCnt    uint32
+	Timestamp uint32
+	IsIgnored bool
+	KeyVer    byte
+}
+
+func (k *FileKey) MarshalStream(w io.Writer) (err error) {
+	err = k.Node.MarshalStream(w)
+	if err != nil {
+		return
+	}
+	err = k.BbsNode.MarshalStream(w)
+	if err != nil {
+		return
+	}
+
+	lw := &leWriter{w: w}
+	lw.write(k.Size)
+	lw.write(k.Hash[:])
+
+	fileName, err := toSjis(k.FileName)
+	if err != nil {
+		return
+	}
+	err = checkLen("file name", len(fileName), math.MaxUint8)
+	if err != nil {
+		return
+	}
+	err = checkLen("BBS trip", len(k.BbsTrip), math.MaxUint8)
+	if err != nil {
+		return
+	}
+	lw.write(byte(len(fileName)))
+
+	var checksum uint32
+	for _, by := range fileName {
+		checksum += uint32(by)
+	}
+	lw.write(uint16(checksum & 0xFFFF))
+
+	cip, _ := rc4.NewCipher([]byte{byte(int(checksum) & 0xFF)})
+	cip.XORKeyStream(fileName, fileName)
+
+	lw.write(fileName)
+
+	lw.write(k.Trip[:])
+	lw.write(byte(len(k.BbsTrip)))
+	lw.write(k.BbsTrip)
+	lw.write(k.Ttl)
+	lw.write(k.RefCnt)
+	lw.write(k.Timestamp)
+	lw.write(toByte(k.IsIgnored))
+	lw.write(k.KeyVer)
+	return lw.err
+}
+
+// UnmarshalStream reads the key. If the file name is not valid Shift-JIS,
+// it reads the whole key and returns ErrEncoding, so that the reader can skip it.
+func (k *FileKey) UnmarshalStream(r io.Reader) (err error) {
+	err = k.Node.UnmarshalStream(r)
+	if err != nil {
+		return
+	}
+	err = k.BbsNode.UnmarshalStream(r)
+	if err != nil {
+		return
+	}
+	err = readField(r, &k.Size)
+	if err != nil {
+		return
+	}
+	err = readField(r, k.Hash[:])
+	if err != nil {
+		return
+	}
+
+	var fileNameLen byte
+	err = readField(r, &fileNameLen)
+	if err != nil {
+		return
+	}
+	var checksum uint16
+	err = readField(r, &checksum)
+	if err != nil {
+		return
+	}
+
+	fileName := make([]byte, fileNameLen)
+	err = readField(r, fileName)
+	if err != nil {
+		return
+	}
+
+	rawFileName := make([]byte, fileNameLen)
+	copy(rawFileName, fileName)
+
+	cip, _ := rc4.NewCipher([]byte{byte(int(checksum) & 0xFF)})
+	cip.XORKeyStream(fileName, fileName)
+
+	var actual uint32
+	for _, by := range fileName {
+		actual += uint32(by)
+	}
+	if uint16(actual&0xFFFF) != checksum {
+		return fmt.Errorf("%w: file name checksum: %d rawFileName: %#v",
+			ErrChecksum,
+			checksum,
+			rawFileName)
+	}
+
+	var encodingErr error
+	k.FileName, encodingErr = toUtf8(fileName)
+
+	err = readField(r, k.Trip[:])
+	if err != nil {
+		return
+	}
+	var bbsTripLen byte
+	err = readField(r, &bbsTripLen)
+	if err != nil {
+		return
+	}
+	k.BbsTrip = make([]byte, bbsTripLen)
+	err = readField(r, k.BbsTrip)
+	if err != nil {
+		return
+	}
+	err = readField(r, &k.Ttl)
+	if err != nil {
+		return
+	}
+	err = readField(r, &k.RefCnt)
+	if err != nil {
+		return
+	}
+	err = readField(r, &k.Timestamp)
+	if err != nil {
+		return
+	}
+	var isIgnored byte
+	err = readField(r, &isIgnored)
+	if err != nil {
+		return
+	}
+	k.IsIgnored = isIgnored != 0
+	err = readField(r, &k.KeyVer)
+	if err != nil {
+		return
+	}
+	return encodingErr
+}
+
+// Basic utility functions for marshaling and unmarshaling
+
+func readLE(r io.Reader, data interface{}) error {
+	return binary.Read(r, binary.LittleEndian, data)
+}
+
+func writeLE(w io.Writer, data interface{}) error {
+	return binary.Write(w, binary.LittleEndian, data)
+}
+
+func toByte(bo bool) byte {
+	if bo {
+		return 1
+	} else {
+		return 0
+	}
+}
+
+func toSjis(s string) (b []byte, err error) {
+	var bs bytes.Buffer
+	w := transform.NewWriter(&bs, japanese.ShiftJIS.NewEncoder())
+	_, err = w.Write([]byte(s))
+	b = bs.Bytes()
+	return
+}
+
+func toUtf8(b []byte) (s string, err error) {
+	r := transform.NewReader(bytes.NewReader(b), japanese.ShiftJIS.NewDecoder())
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrEncoding, err)
+		return
+	}
+	// The decoder replaces invalid bytes instead of failing.
+	// U+FFFD cannot be encoded in Shift-JIS, so it only comes from invalid bytes.
+	if bytes.ContainsRune(raw, utf8.RuneError) {
+		err = fmt.Errorf("%w: invalid Shift-JIS %q", ErrEncoding, b)
+		return
+	}
+	s = string(raw)
+	return
+}
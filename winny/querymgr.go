@@ -1,6 +1,7 @@
 package winny
 
 import (
+	"github.com/peryaudo/goony/winny/proto"
 	"log"
 	"math/rand"
 	"time"
@@ -13,30 +14,51 @@ type queryMgr struct {
 	AddQuery    chan *queryReq
 	RemoveQuery chan chan *FileKey
 
-	AddKeywordStream    chan chan string
-	RemoveKeywordStream chan chan string
+	AddKeywordStream    chan *keywordStreamReq
+	RemoveKeywordStream chan chan *KeywordEvent
 
 	RecvQuery chan *recvCmd // recvCmd.cmd.(type) == *cmdQuery
 
-	keys map[[16]byte]*FileKey
+	// Returns the aggregated announcements of the known keys.
+	GetAggregated chan *aggregatedReq
 
-	queries            map[chan *FileKey]string
-	keywordStreamChans map[chan string]struct{}
+	// Returns a page of the known keys.
+	QueryKeys chan *keyQueryReq
+
+	keys *keyStore
+
+	queries            map[chan *FileKey]*queryReq
+	keywordStreamChans map[chan *KeywordEvent]*keywordStreamReq
+
+	forgeryOffenses map[[4]byte]*forgeryOffense
+
+	dedup *queryDedup
 
 	queryIdCnt uint32
+
+	// Aggregations and key queries in progress, oldest first.
+	pendingAggs       []*aggregatedReq
+	pendingKeyQueries []*keyQueryReq
 }
 
+// Number of the keys aggregated or scanned at once by SearchAggregated and QueryKeys.
+const aggregateBatch = 1000
+
 func newQueryMgr(s *Servent) *queryMgr {
 	return &queryMgr{
 		servent:             s,
 		AddQuery:            make(chan *queryReq),
 		RemoveQuery:         make(chan chan *FileKey),
-		AddKeywordStream:    make(chan chan string),
-		RemoveKeywordStream: make(chan chan string),
-		RecvQuery:           make(chan *recvCmd),
-		keys:                make(map[[16]byte]*FileKey),
-		queries:             make(map[chan *FileKey]string),
-		keywordStreamChans:  make(map[chan string]struct{})}
+		AddKeywordStream:    make(chan *keywordStreamReq),
+		RemoveKeywordStream: make(chan chan *KeywordEvent),
+		RecvQuery:           make(chan *recvCmd, recvCmdBufLen),
+		GetAggregated:       make(chan *aggregatedReq),
+		QueryKeys:           make(chan *keyQueryReq),
+		keys:                newKeyStore(),
+		queries:             make(map[chan *FileKey]*queryReq),
+		keywordStreamChans:  make(map[chan *KeywordEvent]*keywordStreamReq),
+		forgeryOffenses:     make(map[[4]byte]*forgeryOffense),
+		dedup:               newQueryDedup(queryDedupWindow)}
 }
 
 func (m *queryMgr) ListenAndServe() {
@@ -48,16 +70,25 @@ func (m *queryMgr) ListenAndServe() {
 	spreadTimeout := time.After(30 * time.Second)
 	searchTimeout := time.After(10 * time.Second)
 
+	// Always ready while aggregations or key queries are pending.
+	ready := make(chan struct{})
+	close(ready)
+
 	for {
+		var aggregating <-chan struct{}
+		if len(m.pendingAggs) > 0 || len(m.pendingKeyQueries) > 0 {
+			aggregating = ready
+		}
+
 		select {
 		case recvCmd := <-m.RecvQuery:
-			m.dispatchQuery(recvCmd.cmd.(*cmdQuery))
+			m.dispatchQuery(recvCmd)
 
 		case <-spreadTimeout:
 			// SendCmd sends the command to a random single node every time.
-			m.servent.nodeMgr.SendCmd <- &sendCmd{
+			m.servent.nodeMgr.Send(&sendCmd{
 				Direction: directionAll,
-				cmd:       &cmdSpread{}}
+				cmd:       &proto.Spread{}})
 
 			// Adjust cmdSpread interval by connected node count.
 			// By diving the interval by the node count,
@@ -69,7 +100,15 @@ func (m *queryMgr) ListenAndServe() {
 				interval /= time.Duration(nodeCnt)
 			}
 
-			log.Printf("total keys: %d current interval: %d\n", len(m.keys), interval/time.Second)
+			log.Printf("total keys: %d current interval: %d dropped queries: %d dropped results: %d dropped sends: %d\n",
+				m.keys.Len(),
+				interval/time.Second,
+				m.servent.droppedQueries.Load(),
+				m.servent.droppedResults.Load(),
+				m.servent.nodeMgr.droppedCmds.Load())
+
+			m.pruneForgeryOffenses()
+			m.dedup.Prune(time.Now())
 
 			spreadTimeout = time.After(interval)
 
@@ -89,58 +128,97 @@ func (m *queryMgr) ListenAndServe() {
 			*/
 
 		case q := <-m.AddQuery:
-			m.queries[q.Results] = q.Keyword
-			for _, key := range m.keys {
-				if len(q.Keyword) == 0 || key.Match(q.Keyword) {
-					k := *key
-					q.Results <- &k
+			m.queries[q.Results] = q
+			m.keys.Search(q.Query, func(key *FileKey) bool {
+				k := *key
+				if !m.deliverKey(q, &k) {
+					m.removeQuery(q.Results)
+					return false
+				}
+				return true
+			})
+
+		case req := <-m.GetAggregated:
+			if req.Hash != nil {
+				results := make([]*AggregatedKey, 0)
+				if agg := m.keys.Aggregate(*req.Hash); agg != nil {
+					results = append(results, agg)
 				}
+				req.Results <- results
+				continue
 			}
+			req.results = make([]*AggregatedKey, 0)
+			m.pendingAggs = append(m.pendingAggs, req)
+
+		case <-aggregating:
+			if len(m.pendingAggs) > 0 {
+				m.aggregateStep()
+			}
+			if len(m.pendingKeyQueries) > 0 {
+				m.keyQueryStep()
+			}
+
+		case req := <-m.QueryKeys:
+			scan, err := m.keys.newKeyScan(&req.KeyQuery)
+			if err != nil {
+				req.Results <- &keyQueryResult{Err: err}
+				continue
+			}
+			req.scan = scan
+			m.pendingKeyQueries = append(m.pendingKeyQueries, req)
 
 		case ch := <-m.RemoveQuery:
-			delete(m.queries, ch)
+			m.removeQuery(ch)
 
 		case k := <-m.AddKeywordStream:
-			m.keywordStreamChans[k] = struct{}{}
+			m.keywordStreamChans[k.Events] = k
 
 		case ch := <-m.RemoveKeywordStream:
-			delete(m.keywordStreamChans, ch)
+			m.removeKeywordStream(ch)
 		}
 	}
 }
 
-func (m *queryMgr) dispatchQuery(query *cmdQuery) {
-	if query.Keyword == ".jpg" {
-		panic("did it!")
+func (m *queryMgr) dispatchQuery(recvCmd *recvCmd) {
+	query := recvCmd.cmd.(*proto.Query)
+
+	// Drop forged keys. The sender is reported once per query.
+	keys, forgery := m.filterKeys(recvCmd)
+	query.Keys = keys
+	if forgery != nil {
+		m.reportForgery(recvCmd.From, forgery)
 	}
 
-	// Dispatch to search result channels
+	// Save new file keys and dispatch them to search result channels
 	for _, key := range query.Keys {
-		if m.keys[key.Hash] != nil {
+		stored := key
+		id, added := m.keys.Add(&stored)
+		if !added {
 			continue
 		}
+		name := m.keys.Name(id)
 
-		for ch, keyword := range m.queries {
-			if len(keyword) == 0 || key.Match(keyword) {
+		for ch, q := range m.queries {
+			if q.Query.matchNormalized(&key, name) {
 				k := key
-				ch <- &k
+				if !m.deliverKey(q, &k) {
+					m.removeQuery(ch)
+				}
 			}
 		}
 	}
 
-	// Dispatch to keyword stream channels
-	if len(query.Keyword) > 0 {
-		for ch, _ := range m.keywordStreamChans {
-			ch <- query.Keyword
+	// Dispatch to keyword stream channels unless the same query has been reported through another peer
+	duplicate := m.dedup.Seen(originOf(recvCmd), time.Now())
+	if len(query.Keyword) > 0 && !duplicate {
+		event := newKeywordEvent(recvCmd)
+		for ch, r := range m.keywordStreamChans {
+			if !m.deliverKeyword(r, event.clone()) {
+				m.removeKeywordStream(ch)
+			}
 		}
 	}
 
-	// Save file keys
-	for _, key := range query.Keys {
-		k := key
-		m.keys[key.Hash] = &k
-	}
-
 	// Add the addrs in the query to the node list
 	for _, addr := range query.Nodes {
 		m.servent.nodeMgr.AddNodeAddr <- addr
@@ -150,12 +228,36 @@ func (m *queryMgr) dispatchQuery(query *cmdQuery) {
 	}
 }
 
+// removeQuery removes the search subscription and closes its channel.
+// It is a no-op if the subscription is already removed.
+func (m *queryMgr) removeQuery(ch chan *FileKey) {
+	q, ok := m.queries[ch]
+	if !ok {
+		return
+	}
+	delete(m.queries, ch)
+	close(ch)
+	q.sub.Close()
+}
+
+// removeKeywordStream removes the keyword stream and closes its channel.
+// It is a no-op if the keyword stream is already removed.
+func (m *queryMgr) removeKeywordStream(ch chan *KeywordEvent) {
+	r, ok := m.keywordStreamChans[ch]
+	if !ok {
+		return
+	}
+	delete(m.keywordStreamChans, ch)
+	close(ch)
+	r.sub.Close()
+}
+
 // pickAndSearch picks a genuine search query and sends cmdQuery for that.
 // It returns total number of the genuine queries.
 func (m *queryMgr) pickAndSearch() (total int) {
 	total = 0
-	for _, keyword := range m.queries {
-		if len(keyword) > 0 {
+	for _, q := range m.queries {
+		if len(q.Keyword) > 0 {
 			total++
 		}
 	}
@@ -168,20 +270,21 @@ func (m *queryMgr) pickAndSearch() (total int) {
 
 	// Counter for genuine queries (empty queries are ignored and not counted)
 	cnt := 0
-	for _, keyword := range m.queries {
+	for _, q := range m.queries {
+		keyword := q.Keyword
 		if len(keyword) == 0 {
 			continue
 		}
 
 		if cnt == picked {
-			m.servent.nodeMgr.SendCmd <- &sendCmd{
+			m.servent.nodeMgr.Send(&sendCmd{
 				Direction: directionRoughlyUp,
-				cmd: &cmdQuery{
+				cmd: &proto.Query{
 					Id:      m.queryIdCnt,
 					Keyword: keyword,
 					// When node list is empty, nodeConn will add own IP to it.
 					Nodes: make([]nodeAddr, 0),
-					Keys:  make([]FileKey, 0)}}
+					Keys:  make([]FileKey, 0)}})
 			m.queryIdCnt++
 			return
 		}
@@ -190,3 +293,29 @@ func (m *queryMgr) pickAndSearch() (total int) {
 
 	return
 }
+
+// aggregateStep aggregates a batch of the keys for the oldest pending aggregation,
+// so that large aggregations do not block the other requests.
+func (m *queryMgr) aggregateStep() {
+	req := m.pendingAggs[0]
+
+	var done bool
+	req.results, req.next, done = m.keys.SearchAggregated(req.Query, req.next, aggregateBatch, req.results)
+	if !done {
+		return
+	}
+
+	m.pendingAggs = m.pendingAggs[1:]
+	req.Results <- req.results
+}
+
+// keyQueryStep scans a batch of the keys for the oldest pending key query.
+func (m *queryMgr) keyQueryStep() {
+	req := m.pendingKeyQueries[0]
+	if !m.keys.scanKeys(req.scan, aggregateBatch) {
+		return
+	}
+
+	m.pendingKeyQueries = m.pendingKeyQueries[1:]
+	req.Results <- &keyQueryResult{Page: m.keys.keyPage(req.scan)}
+}
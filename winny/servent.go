@@ -2,8 +2,11 @@
 package winny
 
 import (
+	"context"
 	"errors"
+	"github.com/peryaudo/goony/winny/proto"
 	"log"
+	"sync/atomic"
 )
 
 // An Winny servent.
@@ -14,9 +17,37 @@ type Servent struct {
 	Ddns     string
 	Clusters [3]string
 
+	// Client advertised to and required of the peers.
+	// DefaultProfile() is used if nil.
+	Profile *ClientProfile
+
+	// Resolves DDNS host names in the node strings.
+	// net.LookupIP is used if nil.
+	Resolver HostResolver
+
+	// Peers in the blocklist are never connected nor accepted.
+	Blocklist *Blocklist
+
+	// Bandwidth limits in bytes per second shared by all the connections.
+	// UploadLimit defaults to Speed, which is in kbps, to honor the advertised speed.
+	// Zero DownloadLimit or negative limits mean unlimited.
+	UploadLimit   int
+	DownloadLimit int
+
+	// Bandwidth limits in bytes per second for each connection.
+	// Zero or negative limits mean unlimited.
+	ConnUploadLimit   int
+	ConnDownloadLimit int
+
 	recvCmd  chan *recvCmd
 	nodeMgr  *nodeMgr
 	queryMgr *queryMgr
+
+	// Number of queries dropped because the query manager was busy.
+	droppedQueries atomic.Uint64
+
+	// Number of search results and keywords dropped because the subscribers were slow.
+	droppedResults atomic.Uint64
 }
 
 // Starts Winny servent.
@@ -45,23 +76,34 @@ func (s *Servent) ListenAndServe() (err error) {
 		closeConn := false
 
 		switch cmd := recvCmd.cmd.(type) {
-		case *cmdAddr:
-			s.nodeMgr.AddNode <- cmd
-		case *cmdQuery:
-			s.queryMgr.RecvQuery <- recvCmd
+		case *proto.Addr:
+			// Addresses are advisory, so drop them rather than stalling the dispatcher
+			// while the node manager is busy.
+			select {
+			case s.nodeMgr.AddNode <- cmd:
+			default:
+			}
+		case *proto.Query:
+			// Drop the query rather than stalling the dispatcher for everyone
+			// while the query manager is busy.
+			select {
+			case s.queryMgr.RecvQuery <- recvCmd:
+			default:
+				s.droppedQueries.Add(1)
+			}
 
 			// All the commands below indicates disconnection request
-		case *cmdClose:
+		case *proto.Close:
 			closeConn = true
-		case *cmdCloseTransLimit:
+		case *proto.CloseTransLimit:
 			closeConn = true
-		case *cmdCloseBadPort0:
+		case *proto.CloseBadPort0:
 			closeConn = true
-		case *cmdCloseIgnored:
+		case *proto.CloseIgnored:
 			closeConn = true
-		case *cmdCloseSlow:
+		case *proto.CloseSlow:
 			closeConn = true
-		case *cmdCloseForgery:
+		case *proto.CloseForgery:
 			closeConn = true
 
 		default:
@@ -82,13 +124,14 @@ func (s *Servent) init() {
 		return
 	}
 
-	s.recvCmd = make(chan *recvCmd)
+	s.recvCmd = make(chan *recvCmd, recvCmdBufLen)
 	s.nodeMgr = newNodeMgr(s)
 	s.queryMgr = newQueryMgr(s)
 }
 
 // Adds other Winny nodes to the node list.
 // The node string must be in the encrypted form (e.g. @fc259bdf....).
+// The node string may contain a DDNS host name instead of an IP address.
 // Nodes with the private IP addresses are ignored.
 // There's no guarantee that the servent will connect to the given nodes.
 func (s *Servent) AddNode(node string) {
@@ -100,61 +143,123 @@ func (s *Servent) AddNode(node string) {
 	}()
 }
 
-type queryReq struct {
-	Keyword string
-	Results chan *FileKey
+// Returns a subscription streaming the file keys that match the keyword.
+// See CompileQuery for the syntax of the keyword.
+// If the keyword is an empty string, it streams all the file keys.
+// The stream stops when the subscription is closed or the context is canceled,
+// and then the result channel is closed.
+func (s *Servent) Search(ctx context.Context, keyword string, opts SubscriptionOptions) (*SearchSubscription, error) {
+	query, err := CompileQuery(keyword)
+	if err != nil {
+		return nil, err
+	}
+	return s.SearchQuery(ctx, query, opts), nil
 }
 
-// Returns a channel that sends the file keys that match the keyword.
-// If the keyword is an empty string, the channel streams all the file keys.
-// Sending something to the quit channel stops the result stream.
-func (s *Servent) Search(keyword string) (results <-chan *FileKey, quit chan<- struct{}) {
+// Same as Search, but takes a compiled query of any mode, e.g. a regular expression.
+// Both the keys already known and the keys arriving later are matched by the query.
+func (s *Servent) SearchQuery(ctx context.Context, query *Query, opts SubscriptionOptions) *SearchSubscription {
 	s.init()
 
+	sub := newSubscription(ctx)
 	q := &queryReq{
-		Keyword: keyword,
-		Results: make(chan *FileKey)}
+		Keyword: query.Keyword(),
+		Query:   query,
+		Results: make(chan *FileKey, opts.bufLen()),
+		Options: opts,
+		sub:     sub}
 
 	// The function is unblocking because there's no guarantee that the servent is already started.
+	// Adding and removing the query are done in the same goroutine so that they are never reordered.
 	go func() {
-		s.queryMgr.AddQuery <- q
+		select {
+		case s.queryMgr.AddQuery <- q:
+		case <-sub.done:
+			// Closed before added
+			close(q.Results)
+			return
+		}
+		<-sub.done
+		s.queryMgr.RemoveQuery <- q.Results
 	}()
 
-	qu := make(chan struct{})
+	return &SearchSubscription{Subscription: sub, Results: q.Results}
+}
 
-	go func() {
-		// Wait until quit channel receives something and remove the query
-		<-qu
-		s.queryMgr.RemoveQuery <- q.Results
-	}()
+// Returns the aggregated announcements of all the known files matching the query,
+// including all the nodes announcing them.
+// Unlike Search, it returns a snapshot and does not stream the keys arriving later.
+// nil matches all the keys.
+// It blocks until the servent is started.
+func (s *Servent) SearchAggregated(query *Query) []*AggregatedKey {
+	s.init()
 
-	results = q.Results
-	quit = qu
-	return
+	ch := make(chan []*AggregatedKey)
+	s.queryMgr.GetAggregated <- &aggregatedReq{Query: query, Results: ch}
+	return <-ch
+}
+
+// Returns the aggregated announcements of the file with the hash, or nil if the file is unknown.
+// It blocks until the servent is started.
+func (s *Servent) LookupHash(hash [16]byte) *AggregatedKey {
+	s.init()
+
+	ch := make(chan []*AggregatedKey)
+	s.queryMgr.GetAggregated <- &aggregatedReq{Hash: &hash, Results: ch}
+	results := <-ch
+	if len(results) == 0 {
+		return nil
+	}
+	return results[0]
 }
 
-// Returns a channel that streams all the searching keywords flowing through the network.
-// Sending something to the quit channel stops the result stream.
-func (s *Servent) KeywordStream() (keywords <-chan string, quit chan<- struct{}) {
+// Returns a page of the known keys satisfying the conditions,
+// e.g. the keys first seen in a period or the top keys by RefCnt.
+// Pass NextCursor of the page as Cursor to get the next page.
+// It blocks until the servent is started.
+func (s *Servent) QueryKeys(q KeyQuery) (*KeyPage, error) {
 	s.init()
 
-	k := make(chan string)
-	qu := make(chan struct{})
+	ch := make(chan *keyQueryResult)
+	s.queryMgr.QueryKeys <- &keyQueryReq{KeyQuery: q, Results: ch}
+	res := <-ch
+	return res.Page, res.Err
+}
+
+// Returns a subscription streaming all the searching keywords flowing through the network
+// with the metadata of the queries.
+// The stream stops when the subscription is closed or the context is canceled,
+// and then the keyword channel is closed.
+func (s *Servent) KeywordStream(ctx context.Context, opts SubscriptionOptions) *KeywordSubscription {
+	s.init()
+
+	sub := newSubscription(ctx)
+	r := &keywordStreamReq{
+		Events:  make(chan *KeywordEvent, opts.bufLen()),
+		Options: opts,
+		sub:     sub}
 
 	// The function is unblocking because there's no guarantee that the servent is already started.
+	// Adding and removing the stream are done in the same goroutine so that they are never reordered.
 	go func() {
-		s.queryMgr.AddKeywordStream <- k
+		select {
+		case s.queryMgr.AddKeywordStream <- r:
+		case <-sub.done:
+			// Closed before added
+			close(r.Events)
+			return
+		}
+		<-sub.done
+		s.queryMgr.RemoveKeywordStream <- r.Events
 	}()
 
-	go func() {
-		// Wait until quit channel receives something and remove the keyword stream
-		<-qu
-		s.queryMgr.RemoveKeywordStream <- k
-	}()
+	return &KeywordSubscription{Subscription: sub, Events: r.Events}
+}
 
-	keywords = k
-	quit = qu
-	return
+// Returns the total number of search results and keywords dropped
+// because the subscribers were too slow to receive them.
+func (s *Servent) DroppedResults() uint64 {
+	return s.droppedResults.Load()
 }
 
 // Returns the complete node list the servent has.
@@ -165,6 +270,16 @@ func (s *Servent) NodeList() []string {
 	return <-ch
 }
 
+// Returns the census of the known nodes grouped by their client software and conditions.
+// It blocks until the servent is started.
+func (s *Servent) Census() *Census {
+	s.init()
+
+	ch := make(chan *Census)
+	s.nodeMgr.getCensus <- ch
+	return <-ch
+}
+
 // Returns the number of connected nodes.
 // Used by the query manager to adjust request intervals.
 func (s *Servent) connNodeCnt() int {
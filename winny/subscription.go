@@ -0,0 +1,150 @@
+package winny
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Subscription is a stream of search results or keywords.
+// The stream stops when Close is called or the context is canceled.
+type Subscription struct {
+	done      chan struct{}
+	closeOnce sync.Once
+
+	dropped atomic.Uint64
+}
+
+func newSubscription(ctx context.Context) *Subscription {
+	sub := &Subscription{done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Close()
+		case <-sub.done:
+		}
+	}()
+	return sub
+}
+
+// Stops the stream.
+// The channel of the subscription is closed after the subscription is removed,
+// so range loops over it terminate. It is safe to call Close multiple times.
+func (sub *Subscription) Close() {
+	sub.closeOnce.Do(func() {
+		close(sub.done)
+	})
+}
+
+// Returns the number of items dropped because the subscriber was too slow to receive them.
+func (sub *Subscription) Dropped() uint64 {
+	return sub.dropped.Load()
+}
+
+// SearchSubscription streams the file keys matching the keyword.
+type SearchSubscription struct {
+	*Subscription
+	Results <-chan *FileKey
+}
+
+// KeywordSubscription streams the searching keywords flowing through the network.
+type KeywordSubscription struct {
+	*Subscription
+	Events <-chan *KeywordEvent
+}
+
+// OverflowPolicy specifies what to do when a subscriber is too slow to receive
+// and its buffer is full.
+type OverflowPolicy int
+
+const (
+	// Drops the newly arrived item.
+	DropNewest OverflowPolicy = iota
+	// Drops the oldest buffered item to make room for the new one.
+	DropOldest
+	// Removes the subscription and closes its channel.
+	Disconnect
+)
+
+// Default buffer length of the subscription channels.
+const defaultSubscriptionBufLen = 1024
+
+// SubscriptionOptions configures the buffering of a Search or KeywordStream subscription.
+type SubscriptionOptions struct {
+	BufLen   int // defaultSubscriptionBufLen if zero
+	Overflow OverflowPolicy
+}
+
+func (o SubscriptionOptions) bufLen() int {
+	if o.BufLen <= 0 {
+		return defaultSubscriptionBufLen
+	}
+	return o.BufLen
+}
+
+type queryReq struct {
+	Keyword string
+	Query   *Query
+	Results chan *FileKey
+	Options SubscriptionOptions
+
+	sub *Subscription
+}
+
+type aggregatedReq struct {
+	Query   *Query    // nil matches all the keys
+	Hash    *[16]byte // Query is ignored if not nil
+	Results chan []*AggregatedKey
+
+	// Progress of the aggregation, which is done in batches between other requests.
+	next    uint32
+	results []*AggregatedKey
+}
+
+type keywordStreamReq struct {
+	Events  chan *KeywordEvent
+	Options SubscriptionOptions
+
+	sub *Subscription
+}
+
+// deliverKey sends the key to the subscriber without blocking.
+// It returns false if the subscriber should be disconnected.
+func (m *queryMgr) deliverKey(q *queryReq, k *FileKey) bool {
+	return deliver(m, q.Results, k, q.sub, q.Options.Overflow)
+}
+
+// deliverKeyword sends the keyword event to the subscriber without blocking.
+// It returns false if the subscriber should be disconnected.
+func (m *queryMgr) deliverKeyword(r *keywordStreamReq, event *KeywordEvent) bool {
+	return deliver(m, r.Events, event, r.sub, r.Options.Overflow)
+}
+
+// deliver sends the item to the subscription channel without blocking,
+// and applies the overflow policy if the channel is full.
+// It returns false if the subscriber should be disconnected.
+func deliver[T any](m *queryMgr, ch chan T, item T, sub *Subscription, policy OverflowPolicy) bool {
+	select {
+	case ch <- item:
+		return true
+	default:
+	}
+
+	m.servent.droppedResults.Add(1)
+	sub.dropped.Add(1)
+
+	switch policy {
+	case DropOldest:
+		select {
+		case <-ch:
+		default:
+		}
+		select {
+		case ch <- item:
+		default:
+		}
+	case Disconnect:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,124 @@
+package winny
+
+import (
+	"context"
+	"github.com/peryaudo/goony/winny/proto"
+	"testing"
+	"time"
+)
+
+func waitClosed(t *testing.T, ch <-chan *FileKey) {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("result channel not closed")
+		}
+	}
+}
+
+func TestSearchClose(t *testing.T) {
+	s := &Servent{}
+	s.init()
+
+	// Closed before the query manager starts
+	sub, err := s.Search(context.Background(), "", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub.Close()
+	waitClosed(t, sub.Results)
+
+	go s.queryMgr.ListenAndServe()
+	go func() {
+		// Node addresses in the queries are sent to the node manager.
+		for range s.nodeMgr.AddNodeAddr {
+		}
+	}()
+
+	// Canceled through the context
+	ctx, cancel := context.WithCancel(context.Background())
+	sub, err = s.Search(ctx, "", SubscriptionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	waitClosed(t, sub.Results)
+
+	sub.Close()
+}
+
+func TestSubscriptionOverflow(t *testing.T) {
+	s := &Servent{}
+	s.init()
+	go func() {
+		// Node addresses in the queries are sent to the node manager.
+		for range s.nodeMgr.AddNodeAddr {
+		}
+	}()
+
+	now := uint32(time.Now().Unix())
+	query := &proto.Query{Keys: []FileKey{
+		{Node: nodeAddr{IP: [4]byte{1, 1, 1, 1}}, Hash: [16]byte{1}, Timestamp: now},
+		{Node: nodeAddr{IP: [4]byte{1, 1, 1, 1}}, Hash: [16]byte{2}, Timestamp: now},
+		{Node: nodeAddr{IP: [4]byte{1, 1, 1, 1}}, Hash: [16]byte{3}, Timestamp: now}}}
+
+	policies := []OverflowPolicy{DropNewest, DropOldest, Disconnect}
+	subs := make([]*queryReq, len(policies))
+	for i, policy := range policies {
+		subs[i] = &queryReq{
+			Query:   &Query{},
+			Results: make(chan *FileKey, 1),
+			Options: SubscriptionOptions{BufLen: 1, Overflow: policy},
+			sub:     newSubscription(context.Background())}
+		s.queryMgr.queries[subs[i].Results] = subs[i]
+	}
+
+	s.queryMgr.dispatchQuery(&recvCmd{cmd: query})
+
+	if k := <-subs[0].Results; k.Hash[0] != 1 {
+		t.Errorf("DropNewest: expected the first key, actual %#v", k.Hash)
+	}
+	if k := <-subs[1].Results; k.Hash[0] != 3 {
+		t.Errorf("DropOldest: expected the last key, actual %#v", k.Hash)
+	}
+	waitClosed(t, subs[2].Results)
+
+	for i := range policies {
+		if subs[i].sub.Dropped() != 2 && policies[i] != Disconnect {
+			t.Errorf("policy %d: expected 2 dropped, actual %d", i, subs[i].sub.Dropped())
+		}
+	}
+}
+
+func TestKeywordStreamCopies(t *testing.T) {
+	s := &Servent{}
+	s.init()
+	go func() {
+		for range s.nodeMgr.AddNodeAddr {
+		}
+	}()
+
+	subs := make([]*keywordStreamReq, 2)
+	for i := range subs {
+		subs[i] = &keywordStreamReq{
+			Events: make(chan *KeywordEvent, 1),
+			sub:    newSubscription(context.Background())}
+		s.queryMgr.keywordStreamChans[subs[i].Events] = subs[i]
+	}
+
+	query := &proto.Query{Keyword: "foo", Nodes: []nodeAddr{{IP: [4]byte{1, 1, 1, 1}, Port: 1}}}
+	s.queryMgr.dispatchQuery(&recvCmd{cmd: query})
+
+	a, b := <-subs[0].Events, <-subs[1].Events
+	a.Keyword = "modified"
+	a.Path[0] = "modified"
+	if b.Keyword != "foo" || b.Path[0] != "1.1.1.1:1" {
+		t.Errorf("event shared among the subscribers: %#v", b)
+	}
+}
@@ -0,0 +1,126 @@
+package winny
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits bandwidth in bytes per second.
+// It is safe for concurrent use, so a single RateLimiter can be shared by all the connections.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// Replaced by tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// Maximum size of a single write through a throttled connection.
+const throttleChunkSize = 16 * 1024
+
+// Returns a RateLimiter allowing bytesPerSec bytes per second.
+// It returns nil, which limits nothing, if bytesPerSec is not positive.
+func NewRateLimiter(bytesPerSec int) *RateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+
+	// Allow a second worth of burst, but at least a chunk so that a write never waits forever.
+	burst := float64(bytesPerSec)
+	if burst < throttleChunkSize {
+		burst = throttleChunkSize
+	}
+
+	return &RateLimiter{
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep}
+}
+
+// Waits until n bytes are allowed to pass. A nil RateLimiter never waits.
+func (l *RateLimiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	// Reserve the tokens in advance and sleep for the deficit outside the lock.
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		l.sleep(wait)
+	}
+}
+
+// throttledConn limits the bandwidth of the underlying connection.
+// Both of the global limiters shared among connections and the per-connection limiters are applied.
+type throttledConn struct {
+	net.Conn
+
+	up   []*RateLimiter
+	down []*RateLimiter
+}
+
+func (c *throttledConn) Read(b []byte) (n int, err error) {
+	if len(b) > throttleChunkSize {
+		b = b[:throttleChunkSize]
+	}
+	n, err = c.Conn.Read(b)
+	for _, l := range c.down {
+		l.WaitN(n)
+	}
+	return
+}
+
+func (c *throttledConn) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+		for _, l := range c.up {
+			l.WaitN(len(chunk))
+		}
+
+		var written int
+		written, err = c.Conn.Write(chunk)
+		n += written
+		if err != nil {
+			return
+		}
+		b = b[len(chunk):]
+	}
+	return
+}
+
+// throttle wraps the raw connection with the bandwidth limiters configured on the servent.
+func (m *nodeMgr) throttle(conn net.Conn) net.Conn {
+	up := []*RateLimiter{m.upLimiter, NewRateLimiter(m.servent.ConnUploadLimit)}
+	down := []*RateLimiter{m.downLimiter, NewRateLimiter(m.servent.ConnDownloadLimit)}
+	return &throttledConn{Conn: conn, up: up, down: down}
+}
+
+// Converts the speed in kbps advertised by cmdSpeed into bytes per second.
+func speedToBytesPerSec(speed int) int {
+	return speed * 1000 / 8
+}
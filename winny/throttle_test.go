@@ -0,0 +1,109 @@
+package winny
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeClock advances only when the limiter sleeps or the test moves it.
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.slept += d
+	c.now = c.now.Add(d)
+}
+
+func newFakeLimiter(bytesPerSec int) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	l := NewRateLimiter(bytesPerSec)
+	l.now = clock.Now
+	l.sleep = clock.Sleep
+	l.last = clock.now
+	return l, clock
+}
+
+func TestRateLimiter(t *testing.T) {
+	if NewRateLimiter(0) != nil {
+		t.Error("zero limit should be unlimited")
+	}
+
+	l, clock := newFakeLimiter(64 * 1024)
+
+	// A second worth of burst passes at once.
+	l.WaitN(64 * 1024)
+	if clock.slept != 0 {
+		t.Errorf("burst waited %v", clock.slept)
+	}
+
+	// The deficit is waited for at the rate.
+	l.WaitN(32 * 1024)
+	if clock.slept != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms, actual %v", clock.slept)
+	}
+
+	// Tokens refill over time, but never beyond the burst.
+	clock.slept = 0
+	clock.now = clock.now.Add(10 * time.Second)
+	l.WaitN(64 * 1024)
+	if clock.slept != 0 {
+		t.Errorf("refilled tokens waited %v", clock.slept)
+	}
+	l.WaitN(64)
+	if clock.slept != time.Second/1024 {
+		t.Errorf("expected to wait %v, actual %v", time.Second/1024, clock.slept)
+	}
+
+	// Slow limits still allow a chunk at once.
+	l, clock = newFakeLimiter(100)
+	l.WaitN(throttleChunkSize)
+	if clock.slept != 0 {
+		t.Errorf("chunk waited %v", clock.slept)
+	}
+}
+
+// recordingConn records the sizes of the reads and writes.
+type recordingConn struct {
+	net.Conn
+	writes []int
+	reads  []int
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, len(b))
+	return len(b), nil
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	c.reads = append(c.reads, len(b))
+	return len(b), nil
+}
+
+func TestThrottledConn(t *testing.T) {
+	l, clock := newFakeLimiter(throttleChunkSize)
+	raw := &recordingConn{}
+	conn := &throttledConn{Conn: raw, up: []*RateLimiter{l, nil}, down: []*RateLimiter{l}}
+
+	n, err := conn.Write(make([]byte, 2*throttleChunkSize+100))
+	if err != nil || n != 2*throttleChunkSize+100 {
+		t.Fatalf("unexpected write: %d %v", n, err)
+	}
+	if len(raw.writes) != 3 || raw.writes[0] != throttleChunkSize || raw.writes[2] != 100 {
+		t.Errorf("unexpected chunks: %v", raw.writes)
+	}
+	// The first chunk is the burst, and the rest waits a second per chunk.
+	expected := time.Second + time.Second*100/throttleChunkSize
+	if d := clock.slept - expected; d < -time.Microsecond || d > time.Microsecond {
+		t.Errorf("expected to wait %v, actual %v", expected, clock.slept)
+	}
+
+	n, err = conn.Read(make([]byte, 2*throttleChunkSize))
+	if err != nil || n != throttleChunkSize {
+		t.Errorf("reads are not limited to a chunk: %d %v", n, err)
+	}
+}